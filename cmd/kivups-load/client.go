@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tranvaj/UPS2023_SP_GO_1_15_15/util"
+)
+
+var errDropped = errors.New("connection dropped on purpose")
+var errStopped = errors.New("test stopped")
+
+// config is configuration shared by simulated players.
+type config struct {
+	addr      string
+	think     time.Duration
+	ping      time.Duration
+	drop      float64
+	dropDelay time.Duration
+	join      []string
+	boardSize int
+	tls       *tls.Config //connect over TLS if not nil
+}
+
+// client is one simulated player. It logs in, joins games, plays random legal moves and requeues after game over.
+// Everything but reading frames runs in the goroutine of run, so it needs no locking.
+type client struct {
+	name     string
+	config   *config
+	stats    *stats
+	rnd      *rand.Rand
+	conn     util.Transport
+	board    [][]int
+	pending  map[string][]time.Time //send times of requests waiting for response, by opcode
+	action   func()                 //action taken after think time, nil if there is none
+	actionAt <-chan time.Time
+	dropPlan bool //drop the connection on the next turn of the current game
+}
+
+func newClient(name string, config *config, stats *stats, seed int64) *client {
+	return &client{name: name, config: config, stats: stats, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// run plays until stop is closed, dropped and lost connections are reconnected.
+func (c *client) run(stop <-chan struct{}) {
+	for {
+		err := c.session(stop)
+		if err == errStopped {
+			return
+		}
+		delay := time.Second
+		if err == errDropped {
+			c.stats.add(&c.stats.drops, 1)
+			delay = c.config.dropDelay
+		} else {
+			c.stats.add(&c.stats.connErrors, 1)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// session plays on one connection until it is dropped, lost or stop is closed.
+func (c *client) session(stop <-chan struct{}) error {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	var conn net.Conn
+	var err error
+	if c.config.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.config.addr, c.config.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", c.config.addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn = util.NewClientTransport(conn)
+	defer c.conn.Close()
+	c.stats.add(&c.stats.connected, 1)
+	defer c.stats.add(&c.stats.connected, -1)
+	c.pending = make(map[string][]time.Time)
+	c.action = nil
+	c.actionAt = nil
+	c.dropPlan = false
+
+	frames := make(chan util.Frame, 16)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(frames)
+		for {
+			frame, err := c.conn.ReadFrame()
+			if err != nil {
+				return
+			}
+			select {
+			case frames <- frame:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	pings := time.NewTicker(c.config.ping)
+	defer pings.Stop()
+	if err := c.send(util.MsgLoginOpcode, c.name); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stop:
+			return errStopped
+		case frame, ok := <-frames:
+			if !ok {
+				return errors.New("connection closed")
+			}
+			if err := c.handle(frame); err != nil {
+				return err
+			}
+		case <-pings.C:
+			if err := c.send(util.MsgPingOpcode); err != nil {
+				return err
+			}
+		case <-c.actionAt:
+			action := c.action
+			c.action = nil
+			c.actionAt = nil
+			action()
+		}
+	}
+}
+
+// send sends request and records its send time.
+func (c *client) send(opcode string, args ...string) error {
+	c.pending[opcode] = append(c.pending[opcode], time.Now())
+	c.stats.sent(opcode)
+	return c.conn.WriteFrame(util.Frame{Opcode: opcode, Data: []byte(strings.Join(args, util.ArgSep))})
+}
+
+// sendLater sends request after random think time, replacing the previous planned action.
+func (c *client) sendLater(opcode string, args ...string) {
+	c.later(func() {
+		c.send(opcode, args...)
+	})
+}
+
+// later runs action after random think time (0.5 to 1.5 of the configured time).
+func (c *client) later(action func()) {
+	c.action = action
+	c.actionAt = time.After(c.config.think/2 + time.Duration(c.rnd.Int63n(int64(c.config.think)+1)))
+}
+
+// answered records latency of the oldest pending request with opcode, it returns false if there is none.
+func (c *client) answered(opcode string) bool {
+	queue := c.pending[opcode]
+	if len(queue) == 0 {
+		return false
+	}
+	c.pending[opcode] = queue[1:]
+	c.stats.latency(opcode, time.Since(queue[0]))
+	return true
+}
+
+// handle reacts to frame of the server like a player would.
+func (c *client) handle(frame util.Frame) error {
+	args := strings.Split(string(frame.Data), util.ArgSep)
+	reason := "" //error message, empty if the frame is not an error
+	if args[0] != util.ClientMsgOk {
+		reason = strings.Join(args[1:], util.ArgSep)
+	}
+	switch frame.Opcode {
+	case util.MsgLoginOpcode:
+		c.answered(frame.Opcode)
+		if strings.HasPrefix(reason, util.ClientMsgRecoveryLogin) {
+			reason = ""
+			c.send(util.MsgRecoveryOpcode)
+		} else if reason == "" {
+			c.send(util.MsgJoinOpcode, c.config.join...)
+		}
+	case util.MsgRecoveryOpcode:
+		c.answered(frame.Opcode)
+		if reason == "" && len(args) > 1 {
+			c.recover(args[1:])
+		}
+	case util.MsgJoinOpcode:
+		if reason != "" {
+			c.answered(frame.Opcode)
+			c.sendLater(util.MsgJoinOpcode, c.config.join...)
+		}
+	case util.MsgGameStartedOpcode:
+		c.answered(util.MsgJoinOpcode)
+		c.newBoard()
+		c.dropPlan = c.rnd.Float64() < c.config.drop
+	case util.MsgYourTurnOpcode:
+		if c.dropPlan {
+			c.stats.received(frame.Opcode, "")
+			return errDropped
+		}
+		c.later(c.move)
+	case util.MsgMoveOpcode:
+		if c.answered(frame.Opcode) && reason != "" {
+			c.later(c.move) //still on turn
+		}
+		if reason == "" && len(args) > 1 {
+			c.parseBoard(args[1])
+		}
+	case util.MsgGameOverOpcode:
+		reason = ""
+		c.stats.add(&c.stats.games, 1)
+		c.sendLater(util.MsgReturnToStartOpcode)
+	case util.MsgPlayAgainOpcode:
+		if reason == util.ClientMsgGameGone {
+			reason = "" //opponent left after game over, the pending return to start answers gamegone too
+		}
+	case util.MsgReturnToStartOpcode:
+		c.answered(frame.Opcode)
+		if reason == util.ClientMsgGameGone {
+			reason = ""
+		}
+		if reason == "" {
+			c.send(util.MsgJoinOpcode, c.config.join...)
+		} else {
+			c.sendLater(frame.Opcode)
+		}
+	case util.MsgPingOpcode:
+		c.answered(frame.Opcode)
+	case util.MsgErrOpcode:
+		if reason == "" {
+			reason = string(frame.Data)
+		}
+	default:
+		reason = ""
+	}
+	c.stats.received(frame.Opcode, reason)
+	return nil
+}
+
+// recover continues from recovery state of the player.
+func (c *client) recover(args []string) {
+	switch args[0] {
+	case util.ClientMsgRecovery_InLobby:
+		c.send(util.MsgJoinOpcode, c.config.join...)
+	case util.ClientMsgRecovery_InGame_YourTurn:
+		if len(args) > 1 {
+			c.parseBoard(args[1])
+		}
+		c.later(c.move)
+	case util.ClientMsgRecovery_InGame_OtherTurn:
+		if len(args) > 1 {
+			c.parseBoard(args[1])
+		}
+	case util.ClientMsgRecovery_InGame_GameOver, util.ClientMsgRecovery_InGame_GameGone:
+		c.sendLater(util.MsgReturnToStartOpcode)
+	}
+}
+
+// move sends move to a random empty cell.
+func (c *client) move() {
+	var empty [][2]int
+	for x, row := range c.board {
+		for y, v := range row {
+			if v == 0 {
+				empty = append(empty, [2]int{x, y})
+			}
+		}
+	}
+	if len(empty) == 0 {
+		return
+	}
+	cell := empty[c.rnd.Intn(len(empty))]
+	c.send(util.MsgMoveOpcode, strconv.Itoa(cell[0]), strconv.Itoa(cell[1]))
+}
+
+// newBoard resets the board to an empty board of the configured size.
+func (c *client) newBoard() {
+	c.board = make([][]int, c.config.boardSize)
+	for i := range c.board {
+		c.board[i] = make([]int, c.config.boardSize)
+	}
+}
+
+// parseBoard reads board in parsable format, invalid board leaves the board unchanged.
+func (c *client) parseBoard(board string) {
+	if parsed, err := util.ParseBoard(board); err == nil {
+		c.board = parsed
+	}
+}
@@ -0,0 +1,143 @@
+// Command kivups-load is a load testing tool of the KIVUPS server. It spawns simulated players that log in, keep up
+// pings, join games, play random legal moves and requeue after game over, optionally dropping their connection
+// during a game and recovering it. Throughput, latency percentiles and errors per opcode are reported at the end.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tranvaj/UPS2023_SP_GO_1_15_15/util"
+)
+
+func main() {
+	addr := flag.String("addr", util.ConnHost+":"+util.ConnPort, "address of the server")
+	clients := flag.Int("clients", 100, "number of simulated players")
+	ramp := flag.Duration("ramp", 10*time.Second, "time over which the players connect")
+	duration := flag.Duration("duration", time.Minute, "duration of the test including the ramp")
+	think := flag.Duration("think", 500*time.Millisecond, "mean time a player thinks before a move or requeue")
+	ping := flag.Duration("ping", util.PingTime*time.Second, "time between pings of a player")
+	drop := flag.Float64("drop", 0, "probability that a player drops its connection during a game and recovers it")
+	dropDelay := flag.Duration("drop-delay", 2*time.Second, "time a dropped player stays disconnected")
+	join := flag.String("join", util.GameTypeClassic, "arguments of join separated by ; (classic two seat game without wild rule, e.g. classic;size=5;line=4)")
+	name := flag.String("name", "load", "prefix of player names, names must not collide with players of another run")
+	report := flag.Duration("report", 5*time.Second, "interval of progress lines (disabled if 0)")
+	useTLS := flag.Bool("tls", false, "connect over TLS")
+	tlsCA := flag.String("tls-ca", "", "CA file of the server certificate (system roots if empty)")
+	tlsServerName := flag.String("tls-server-name", "", "name the server certificate is verified for (host of -addr if empty)")
+	tlsCert := flag.String("tls-cert", "", "client certificate file, for servers started with -tls-client-ca")
+	tlsKey := flag.String("tls-key", "", "private key file of the client certificate")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of think times, moves and drops")
+	flag.Parse()
+
+	joinArgs := strings.Split(*join, util.ArgSep)
+	boardSize, err := parseBoardSize(joinArgs)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("-join: %v", err)
+	case *clients <= 0:
+		err = fmt.Errorf("-clients must be positive")
+	case *think < 0:
+		err = fmt.Errorf("-think must not be negative")
+	case *ping <= 0:
+		err = fmt.Errorf("-ping must be positive")
+	case *drop < 0 || *drop > 1:
+		err = fmt.Errorf("-drop must be between 0 and 1")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	config := &config{addr: *addr, think: *think, ping: *ping, drop: *drop, dropDelay: *dropDelay, join: joinArgs,
+		boardSize: boardSize}
+	if *useTLS {
+		config.tls, err = util.NewClientTLSConfig(util.ClientTLSOptions{CAFile: *tlsCA, ServerName: *tlsServerName,
+			CertFile: *tlsCert, KeyFile: *tlsKey})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid TLS configuration:", err)
+			os.Exit(2)
+		}
+	}
+	stats := newStats()
+
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		var running []chan struct{}
+		defer func() {
+			for _, v := range running {
+				<-v
+			}
+		}()
+		for i := 0; i < *clients; i++ {
+			c := newClient(*name+strconv.Itoa(i), config, stats, *seed+int64(i))
+			done := make(chan struct{})
+			running = append(running, done)
+			go func() {
+				defer close(done)
+				c.run(stop)
+			}()
+			select {
+			case <-stop:
+				return
+			case <-time.After(*ramp / time.Duration(*clients)):
+			}
+		}
+	}()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	start := time.Now()
+	end := time.After(*duration)
+	var progress <-chan time.Time
+	if *report > 0 {
+		ticker := time.NewTicker(*report)
+		defer ticker.Stop()
+		progress = ticker.C
+	}
+loop:
+	for {
+		select {
+		case <-progress:
+			stats.progress(os.Stdout, time.Since(start))
+		case <-end:
+			break loop
+		case <-interrupted:
+			break loop
+		}
+	}
+	close(stop)
+	<-finished
+	stats.report(os.Stdout, time.Since(start))
+}
+
+// parseBoardSize returns board size of games joined with args. Simulated players fill any empty cell with
+// their own symbol, so only classic two seat games without wild rule are supported.
+func parseBoardSize(args []string) (int, error) {
+	if args[0] != "" && args[0] != util.GameTypeClassic {
+		return 0, fmt.Errorf("unsupported game type %s, only classic games are supported", args[0])
+	}
+	size := 3
+	for _, v := range args[1:] {
+		switch {
+		case strings.HasPrefix(v, util.RuleSize):
+			n, err := strconv.Atoi(strings.TrimPrefix(v, util.RuleSize))
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid rule %s", v)
+			}
+			size = n
+		case v == util.RuleWild:
+			return 0, fmt.Errorf("unsupported rule %s, moves would need a chosen symbol", v)
+		case strings.HasPrefix(v, util.RuleSeats) && v != util.RuleSeats+"2":
+			return 0, fmt.Errorf("unsupported rule %s, only two seat games are supported", v)
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tranvaj/UPS2023_SP_GO_1_15_15/util"
+)
+
+// opcodeNames are names of opcodes in reports.
+var opcodeNames = map[string]string{
+	util.MsgLoginOpcode:         "login",
+	util.MsgJoinOpcode:          "join",
+	util.MsgMoveOpcode:          "move",
+	util.MsgPlayAgainOpcode:     "playagain",
+	util.MsgGameStartedOpcode:   "gamestarted",
+	util.MsgReturnToStartOpcode: "returntostart",
+	util.MsgGameOverOpcode:      "gameover",
+	util.MsgErrOpcode:           "err",
+	util.MsgYourTurnOpcode:      "yourturn",
+	util.MsgPingOpcode:          "ping",
+	util.MsgRecoveryOpcode:      "recovery",
+	util.MsgPauseOpcode:         "pause",
+	util.MsgContinueOpcode:      "continue",
+	util.MsgStatusOpcode:        "status",
+}
+
+// opStats are counters of one opcode.
+type opStats struct {
+	sent      int
+	received  int
+	errors    int
+	reasons   map[string]int  //errors by reason
+	latencies []time.Duration //times from request to its response
+}
+
+// stats are counters shared by all simulated players.
+type stats struct {
+	ops        map[string]*opStats
+	connected  int //players connected now
+	games      int //games finished
+	drops      int //connections dropped on purpose
+	connErrors int //connections that could not be made or were closed by the server
+	mu         sync.Mutex
+}
+
+func newStats() *stats {
+	return &stats{ops: make(map[string]*opStats)}
+}
+
+// op returns counters of opcode, caller must hold s.mu.
+func (s *stats) op(opcode string) *opStats {
+	v, ok := s.ops[opcode]
+	if !ok {
+		v = &opStats{reasons: make(map[string]int)}
+		s.ops[opcode] = v
+	}
+	return v
+}
+
+func (s *stats) sent(opcode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.op(opcode).sent++
+}
+
+// received counts frame of the server, reason is empty unless the frame is an error.
+func (s *stats) received(opcode string, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := s.op(opcode)
+	v.received++
+	if reason != "" {
+		v.errors++
+		v.reasons[reason]++
+	}
+}
+
+// latency records time from request with opcode to its response.
+func (s *stats) latency(opcode string, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := s.op(opcode)
+	v.latencies = append(v.latencies, latency)
+}
+
+// add adds n to the counter.
+func (s *stats) add(counter *int, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*counter += n
+}
+
+// progress writes one line with totals since start.
+func (s *stats) progress(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent, received, errors := s.totals()
+	fmt.Fprintf(w, "%6.0fs connected=%d games=%d sent=%d received=%d errors=%d drops=%d connerrors=%d\n",
+		elapsed.Seconds(), s.connected, s.games, sent, received, errors, s.drops, s.connErrors)
+}
+
+// totals returns numbers of sent and received frames and errors, caller must hold s.mu.
+func (s *stats) totals() (sent int, received int, errors int) {
+	for _, v := range s.ops {
+		sent += v.sent
+		received += v.received
+		errors += v.errors
+	}
+	return sent, received, errors
+}
+
+// report writes throughput, latency percentiles and errors per opcode.
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seconds := elapsed.Seconds()
+	sent, received, errors := s.totals()
+	fmt.Fprintf(w, "\nduration %v, games %d (%.1f/s), sent %d (%.1f/s), received %d (%.1f/s), errors %d, drops %d, connection errors %d\n\n",
+		elapsed.Round(time.Millisecond), s.games, float64(s.games)/seconds, sent, float64(sent)/seconds,
+		received, float64(received)/seconds, errors, s.drops, s.connErrors)
+
+	opcodes := make([]string, 0, len(s.ops))
+	for opcode := range s.ops {
+		opcodes = append(opcodes, opcode)
+	}
+	sort.Strings(opcodes)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "opcode\tsent\treceived\terrors\tp50\tp90\tp99\tmax\t")
+	for _, opcode := range opcodes {
+		v := s.ops[opcode]
+		name := opcodeName(opcode)
+		sort.Slice(v.latencies, func(i, j int) bool { return v.latencies[i] < v.latencies[j] })
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t\n", name, v.sent, v.received, v.errors,
+			percentile(v.latencies, 50), percentile(v.latencies, 90), percentile(v.latencies, 99), percentile(v.latencies, 100))
+	}
+	tw.Flush()
+
+	for _, opcode := range opcodes {
+		reasons := make([]string, 0, len(s.ops[opcode].reasons))
+		for reason := range s.ops[opcode].reasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "error %s %q: %d\n", opcodeName(opcode), reason, s.ops[opcode].reasons[reason])
+		}
+	}
+}
+
+// opcodeName returns name of opcode in reports.
+func opcodeName(opcode string) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+	return opcode
+}
+
+// percentile returns p-th percentile of sorted latencies, "-" if there are none.
+func percentile(latencies []time.Duration, p int) string {
+	if len(latencies) == 0 {
+		return "-"
+	}
+	i := (len(latencies)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return latencies[i].Round(10 * time.Microsecond).String()
+}
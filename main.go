@@ -1,36 +1,210 @@
 package main
 
 import (
-	"fmt"
+	"crypto/tls"
+	"flag"
 	"net"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/tranvaj/UPS2023_SP_GO_1_15_15/util"
 )
 
 func main() {
-	var clientId int = 1
+	logLevel := flag.String("log-level", "info", "log verbosity (debug, info, warn, error)")
+	logFormat := flag.String("log-format", "logfmt", "log output format (logfmt, json)")
+	metricsAddr := flag.String("metrics-addr", "", "address of HTTP listener serving /metrics (disabled if empty)")
+	adminAddr := flag.String("admin-addr", "", "local address of the admin API (disabled if empty), e.g. 127.0.0.1:8081")
+	consolePath := flag.String("console-socket", "", "path of unix socket serving the admin console (disabled if empty)")
+	adminToken := flag.String("admin-token", os.Getenv("KIVUPS_ADMIN_TOKEN"), "bearer token required by the admin API (default $KIVUPS_ADMIN_TOKEN)")
+	banFile := flag.String("ban-file", "", "file the ban list is loaded from and saved to (not persisted if empty)")
+	tlsCert := flag.String("tls-cert", "", "certificate file of the game listener (TLS disabled if empty)")
+	tlsKey := flag.String("tls-key", "", "private key file of the game listener")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file, if set clients must present certificate signed by it")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "use TLS with certificate generated at startup (development only)")
+	wsAddr := flag.String("ws-addr", "", "address of HTTP listener serving the game over WebSocket at /ws (disabled if empty)")
+	wsOrigins := flag.String("ws-origins", "", "comma separated origins allowed to open WebSocket (any if empty), e.g. https://example.com")
+	sendQueue := flag.Int("send-queue", util.OutboundQueueLen, "number of messages queued for sending to one client")
+	writeTimeout := flag.Duration("write-timeout", time.Second*util.WriteTimeout, "time to send one message before the client is disconnected")
+	backpressure := flag.String("backpressure", util.BackpressureDisconnect, "what to do when send queue of a client is full (disconnect, drop)")
+	listenAddr := flag.String("addr", util.ConnHost+":"+util.ConnPort, "address of the game listener")
+	sessionFile := flag.String("session-file", "", "session file shared with other instances on this host (sessions kept in memory if empty)")
+	nodeAddr := flag.String("node-addr", "", "plain TCP game address other instances hand off clients of players owned by this instance to (single instance if empty)")
+	nodeSecret := flag.String("node-secret", os.Getenv("KIVUPS_NODE_SECRET"), "secret shared by instances, authenticates clients handed off by instances other than -cluster-peers (default $KIVUPS_NODE_SECRET)")
+	clusterAddr := flag.String("cluster-addr", "", "address of listener answering other nodes of the cluster (cluster disabled if empty)")
+	clusterPeers := flag.String("cluster-peers", "", "comma separated cluster listener addresses of the other nodes, e.g. 10.0.0.2:9200")
+	maxPlayers := flag.Int("max-players", util.MaxClients, "max number of logged in players")
+	maxConns := flag.Int("max-conns", util.MaxConns, "max number of open connections")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", util.MaxConnsPerIP, "max number of open connections from one IP address")
+	maxUnauthConns := flag.Int("max-unauth-conns", util.MaxUnauthConns, "max number of open connections without logged in player")
+	flag.Parse()
 
-	fmt.Println("Starting " + util.ConnType + " server on " + util.ConnHost + ":" + util.ConnPort)
-	l, err := net.Listen(util.ConnType, util.ConnHost+":"+util.ConnPort)
+	level, err := util.ParseLogLevel(*logLevel)
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
+		util.Log.Error("invalid log level", util.F("error", err))
 		os.Exit(1)
 	}
-	defer l.Close()
+	format, err := util.ParseLogFormat(*logFormat)
+	if err != nil {
+		util.Log.Error("invalid log format", util.F("error", err))
+		os.Exit(1)
+	}
+	util.Log.SetLevel(level)
+	util.Log.SetFormat(format)
+
+	err = util.ConfigureOutbound(*sendQueue, *writeTimeout, *backpressure)
+	if err != nil {
+		util.Log.Error("invalid send queue configuration", util.F("error", err))
+		os.Exit(1)
+	}
+
+	err = util.ConfigureCapacity(*maxPlayers, *maxConns, *maxConnsPerIP, *maxUnauthConns)
+	if err != nil {
+		util.Log.Error("invalid capacity configuration", util.F("error", err))
+		os.Exit(1)
+	}
+
+	err = util.LoadBans(*banFile)
+	if err != nil {
+		util.Log.Error("could not load ban list", util.F("error", err))
+		os.Exit(1)
+	}
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+	if *adminAddr != "" {
+		if *adminToken == "" {
+			util.Log.Error("admin API requires a token")
+			os.Exit(1)
+		}
+		go serveAdmin(*adminAddr, *adminToken)
+	}
+	if *consolePath != "" {
+		go func() {
+			err := util.ServeConsole(*consolePath)
+			if err != nil {
+				util.Log.Error("admin console failed", util.F("error", err))
+			}
+		}()
+	}
 
-	for {
-		c, err := l.Accept()
+	tlsOptions := util.TLSOptions{
+		CertFile:     *tlsCert,
+		KeyFile:      *tlsKey,
+		ClientCAFile: *tlsClientCA,
+		SelfSigned:   *tlsSelfSigned,
+		Hosts:        []string{util.ConnHost, "localhost"},
+	}
+	if *nodeAddr != "" && tlsOptions.Enabled() {
+		//instances relay clients to each other over plain TCP, there is no plain game listener with TLS
+		util.Log.Error("handing off clients with -node-addr cannot be used with TLS")
+		os.Exit(1)
+	}
+	if *nodeAddr != "" && *nodeSecret == "" && *clusterPeers == "" {
+		util.Log.Error("handing off clients requires -node-secret or -cluster-peers")
+		os.Exit(1)
+	}
+	if *sessionFile != "" {
+		util.ConfigureSessions(util.NewFileSessionStore(*sessionFile), *nodeAddr, *nodeSecret)
+	} else {
+		util.ConfigureSessions(util.NewMemorySessionStore(), *nodeAddr, *nodeSecret)
+	}
+
+	if *clusterPeers != "" {
+		peers := make([]string, 0)
+		for _, v := range strings.Split(*clusterPeers, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				peers = append(peers, v)
+			}
+		}
+		err = util.ConfigureCluster(peers)
 		if err != nil {
-			fmt.Println("Error connecting:", err.Error())
-			return
+			util.Log.Error("invalid cluster configuration", util.F("error", err))
+			os.Exit(1)
 		}
-		player := &util.Player{Conn: &c, ClientId: clientId, TimeSinceLastPing: time.Now()}
-		//fmt.Println("Client connected.")
-		fmt.Println("Client " + c.RemoteAddr().String() + " connected.")
-		clientId++
-		//go util.ConnectionCloseHandler(player)
-		go util.ProcessClient(c, player)
+	}
+	if *clusterAddr != "" {
+		go func() {
+			err := util.ServeCluster(*clusterAddr)
+			if err != nil {
+				util.Log.Error("cluster listener failed", util.F("error", err))
+			}
+		}()
+	}
+
+	util.Log.Info("starting server", util.F("network", util.ConnType), util.F("address", *listenAddr))
+	l, err := net.Listen(util.ConnType, *listenAddr)
+	if err != nil {
+		util.Log.Error("error listening", util.F("error", err))
+		os.Exit(1)
+	}
+	defer l.Close()
+	var tlsConfig *tls.Config
+	if tlsOptions.Enabled() {
+		tlsConfig, err = util.NewTLSConfig(tlsOptions)
+		if err != nil {
+			util.Log.Error("invalid TLS configuration", util.F("error", err))
+			os.Exit(1)
+		}
+		l = tls.NewListener(l, tlsConfig)
+		util.Log.Info("TLS enabled", util.F("client_auth", *tlsClientCA != ""))
+	} else if *tlsClientCA != "" {
+		util.Log.Error("client certificate authentication requires TLS")
+		os.Exit(1)
+	}
+
+	if *wsAddr != "" {
+		go serveWebSocket(*wsAddr, *wsOrigins, tlsConfig)
+	}
+
+	err = util.Serve(l)
+	util.Log.Error("error connecting", util.F("error", err))
+}
+
+// serveWebSocket serves game protocol over WebSocket on addr, using TLS if config is not nil.
+func serveWebSocket(addr string, origins string, config *tls.Config) {
+	allowed := make([]string, 0)
+	for _, v := range strings.Split(origins, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			allowed = append(allowed, v)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/ws", util.WebSocketHandler(allowed, util.AcceptClient))
+	l, err := net.Listen(util.ConnType, addr)
+	if err != nil {
+		util.Log.Error("websocket listener failed", util.F("error", err))
+		return
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	util.Log.Info("serving websocket", util.F("address", addr), util.F("tls", config != nil))
+	err = http.Serve(l, mux)
+	if err != nil {
+		util.Log.Error("websocket listener failed", util.F("error", err))
+	}
+}
+
+// serveMetrics serves Prometheus metrics on addr.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", util.MetricsHandler())
+	util.Log.Info("serving metrics", util.F("address", addr))
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		util.Log.Error("metrics listener failed", util.F("error", err))
+	}
+}
+
+// serveAdmin serves the admin API on addr.
+func serveAdmin(addr string, token string) {
+	util.Log.Info("serving admin API", util.F("address", addr))
+	err := http.ListenAndServe(addr, util.AdminHandler(token))
+	if err != nil {
+		util.Log.Error("admin listener failed", util.F("error", err))
 	}
 }
@@ -0,0 +1,248 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Operations used by the admin interfaces (HTTP API and console).
+// They use the same registry and game list as the protocol handlers and hold stateMutex like them.
+
+// player status names used by admin interfaces
+var playerStatusNames = map[int]string{InLobby: "lobby", InGame: "game", ReadyForGame: "ready"}
+
+// PlayerInfo is a snapshot of a logged in player.
+type PlayerInfo struct {
+	Id              int     `json:"id"`
+	Name            string  `json:"name"`
+	ClientId        int     `json:"client_id"`
+	Remote          string  `json:"remote"`
+	Status          string  `json:"status"`
+	Connected       bool    `json:"connected"`
+	LastPingAgeSecs float64 `json:"last_ping_age_seconds"`
+	RttMs           int64   `json:"rtt_ms,omitempty"`
+	GameId          int     `json:"game_id,omitempty"`
+}
+
+// SeatInfo is a snapshot of a seat of a game.
+type SeatInfo struct {
+	Seat     int    `json:"seat"`
+	PlayerId int    `json:"player_id"`
+	Name     string `json:"name"`
+	Ready    bool   `json:"ready"`
+}
+
+// GameInfo is a snapshot of a game.
+type GameInfo struct {
+	Id        int        `json:"id"`
+	Type      string     `json:"type"`
+	Rules     string     `json:"rules"`
+	State     string     `json:"state"`
+	Result    string     `json:"result,omitempty"`
+	EndReason string     `json:"end_reason,omitempty"`
+	Board     string     `json:"board"`
+	Seats     []SeatInfo `json:"seats"`
+}
+
+// listPlayers returns snapshots of all logged in players.
+func listPlayers() []PlayerInfo {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	result := make([]PlayerInfo, 0)
+	for _, v := range players.GetLoggedInPlayers() {
+		info := PlayerInfo{
+			Id:              v.Id,
+			Name:            v.Name,
+			ClientId:        v.ClientId,
+			Status:          playerStatusNames[v.Status],
+			Connected:       v.Connected,
+			LastPingAgeSecs: v.getTimeSinceLastPing().Seconds(),
+			RttMs:           v.Rtt.Milliseconds(),
+		}
+		if v.Conn != nil {
+			info.Remote = v.Conn.RemoteAddr().String()
+		}
+		if game := findGame(v); game != nil {
+			info.GameId = game.GetId()
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
+// listGames returns snapshots of all games.
+func listGames() []GameInfo {
+	gameListMutex.Lock()
+	games := make([]*TicTacToeGame, len(availableGamesList))
+	copy(games, availableGamesList)
+	gameListMutex.Unlock()
+
+	result := make([]GameInfo, 0, len(games))
+	for _, game := range games {
+		result = append(result, getGameInfo(game))
+	}
+	return result
+}
+
+// getGameInfo returns snapshot of the game.
+func getGameInfo(game *TicTacToeGame) GameInfo {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	info := GameInfo{
+		Id:    game.GetId(),
+		Type:  game.GetGameTypeName(),
+		Rules: game.GetRules().String(),
+		State: gameStateNames[game.GetState()],
+		Board: game.GetBoardInParsableFormat(),
+		Seats: make([]SeatInfo, 0),
+	}
+	if game.GetGameOverState() != NotOver {
+		info.Result = game.GetGameResult()
+		info.EndReason = game.GetEndReason()
+	}
+	game.mu.Lock()
+	for i, v := range game.players {
+		info.Seats = append(info.Seats, SeatInfo{Seat: i + 1, PlayerId: v.Id, Name: v.Name, Ready: game.ready[i]})
+	}
+	game.mu.Unlock()
+	return info
+}
+
+// findGameById returns game with the given id or nil.
+func findGameById(id int) *TicTacToeGame {
+	gameListMutex.Lock()
+	defer gameListMutex.Unlock()
+	for _, v := range availableGamesList {
+		if v.GetId() == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// kickPlayer disconnects logged in player with the given name the same way as a timed out player.
+func kickPlayer(name string, reason string) error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	player := players.GetPlayerByName(name)
+	if player == nil {
+		return fmt.Errorf("player %s not found", name)
+	}
+	playerLog(player).Info("kicking player", F("reason", reason))
+	conn := player.Conn
+	if conn != nil {
+		_, err := sendMsg(conn, createOpCode(MsgStatusOpcode, false, "You were kicked: "+reason), 0)
+		if err != nil {
+			playerLog(player).Warn("could not send kick status to player", F(logKeyError, err))
+		}
+	}
+	playerDisconnected(player)
+	if conn != nil {
+		conn.Close()
+	}
+	return nil
+}
+
+// endGame ends the game in play without result and announces it to the players.
+func endGame(id int, reason string) error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	game := findGameById(id)
+	if game == nil {
+		return fmt.Errorf("game %d not found", id)
+	}
+	err := game.Abort()
+	if err != nil {
+		return err
+	}
+	recordGameEnd(game)
+	errs := broadcastMsg(getGameConnections(game), createOpCode(MsgGameOverOpcode, true, game.GetGameResult()+"("+reason+")"), 0)
+	if errs != nil {
+		Log.Warn("could not broadcast game over to all players", F(logKeyGameId, id), F(logKeyError, errs[0]))
+	}
+	return nil
+}
+
+// broadcastStatus sends status message to all logged in players, it returns number of players reached.
+func broadcastStatus(msg string) (int, error) {
+	maxLen := MaxDataLen - len(ClientMsgOk+ArgSep) //status data starts with ok
+	if len(msg) == 0 || len(msg) > maxLen {
+		return 0, fmt.Errorf("message must have 1 to %d characters", maxLen)
+	}
+	msg = strings.ReplaceAll(msg, ArgSep, " ")
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	sent := 0
+	for _, v := range players.GetLoggedInPlayers() {
+		if v.Conn == nil {
+			continue
+		}
+		_, err := sendMsg(v.Conn, createOpCode(MsgStatusOpcode, true, msg), int(atomic.LoadInt64(&pingTime)))
+		if err != nil {
+			playerLog(v).Warn("could not send status to player", F(logKeyError, err))
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// banTarget bans player name, IP address or CIDR range and kicks matching logged in players.
+// Duration 0 means permanent ban. It returns description of the ban.
+func banTarget(target string, reason string, duration time.Duration) (string, error) {
+	if target == "" {
+		return "", fmt.Errorf("missing name, ip or cidr")
+	}
+	kind := getBanKind(target)
+	ban, err := bans.Add(kind, target, reason, duration)
+	if err != nil {
+		return "", err
+	}
+	kicked := 0
+	if kind == BanKindName {
+		if kickPlayer(target, reason) == nil {
+			kicked++
+		}
+	} else {
+		banRange := getBanRange(target)
+		names := make([]string, 0)
+		stateMutex.Lock()
+		for _, v := range players.GetLoggedInPlayers() {
+			if v.Conn != nil && banRange.Contains(getAddrIP(v.Conn.RemoteAddr())) {
+				names = append(names, v.Name)
+			}
+		}
+		stateMutex.Unlock()
+		for _, name := range names {
+			if kickPlayer(name, reason) == nil {
+				kicked++
+			}
+		}
+	}
+	Log.Info("ban added", F("kind", kind), F("target", target), F("reason", reason), F("expires", ban.Expires))
+	return fmt.Sprintf("banned %s %s%s, kicked %d player(s)", kind, target, getBanExpiry(ban), kicked), nil
+}
+
+// unbanTarget removes ban of player name, IP address or CIDR range.
+func unbanTarget(target string) error {
+	kind := getBanKind(target)
+	removed, err := bans.Remove(kind, target)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("%s %s is not banned", kind, target)
+	}
+	Log.Info("ban removed", F("kind", kind), F("target", target))
+	return nil
+}
+
+// getBanExpiry returns description of ban expiry.
+func getBanExpiry(ban Ban) string {
+	if ban.Expires.IsZero() {
+		return ""
+	}
+	return " until " + ban.Expires.Format(time.RFC3339)
+}
@@ -0,0 +1,23 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBroadcastStatusLength(t *testing.T) {
+	maxLen := MaxDataLen - len(ClientMsgOk+ArgSep)
+	if _, err := broadcastStatus(strings.Repeat("a", maxLen+1)); err == nil {
+		t.Error("status longer than data of a message accepted")
+	}
+	defer kickTestPlayers("status1")
+	c := connectTestClient(t)
+	defer c.conn.Close()
+	c.login("status1")
+	if _, err := broadcastStatus(strings.Repeat("a", maxLen)); err != nil {
+		t.Fatal(err)
+	}
+	if data := c.expect(MsgStatusOpcode).Data; len(data) > MaxDataLen {
+		t.Errorf("status data has %d bytes, limit is %d", len(data), MaxDataLen)
+	}
+}
@@ -0,0 +1,145 @@
+package util
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminHandler returns handler of the admin HTTP/JSON API. Every request must carry
+// header "Authorization: Bearer <token>".
+//
+// Endpoints:
+//   - GET  /admin/players                     list logged in players
+//   - GET  /admin/games                       list games with board, state and seats
+//   - POST /admin/players/kick?name=<name>    disconnect player
+//   - POST /admin/games/end?id=<id>           end game without result
+//   - POST /admin/broadcast                   send {"message": "..."} as status to everyone
+//   - GET  /admin/bans                        list active bans
+//   - POST /admin/bans/add?target=<t>         ban name, ip or cidr, optional duration=30m (permanent if missing) and reason
+//   - POST /admin/bans/remove?target=<t>      remove ban
+//   - POST /admin/bans/reload                 reload bans from the ban file
+func AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/players", adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, listPlayers())
+	}))
+	mux.HandleFunc("/admin/games", adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, listGames())
+	}))
+	mux.HandleFunc("/admin/players/kick", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		err := kickPlayer(r.URL.Query().Get("name"), "kicked by admin")
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	}))
+	mux.HandleFunc("/admin/games/end", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid game id")
+			return
+		}
+		if findGameById(id) == nil {
+			writeAdminError(w, http.StatusNotFound, "game not found")
+			return
+		}
+		err = endGame(id, "Ended by admin")
+		if err != nil {
+			writeAdminError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	}))
+	mux.HandleFunc("/admin/broadcast", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Message string `json:"message"`
+		}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid body")
+			return
+		}
+		sent, err := broadcastStatus(body.Message)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]int{"sent": sent})
+	}))
+	mux.HandleFunc("/admin/bans", adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, bans.List())
+	}))
+	mux.HandleFunc("/admin/bans/add", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		duration, err := parseBanDuration(query.Get("duration"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		reason := query.Get("reason")
+		if reason == "" {
+			reason = "banned by admin"
+		}
+		result, err := banTarget(query.Get("target"), reason, duration)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"result": result})
+	}))
+	mux.HandleFunc("/admin/bans/remove", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		err := unbanTarget(r.URL.Query().Get("target"))
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	}))
+	mux.HandleFunc("/admin/bans/reload", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		err := bans.Reload()
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	}))
+	return adminAuth(token, mux)
+}
+
+// adminAuth rejects requests without the bearer token.
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminMethod rejects requests with other method than the given one.
+func adminMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		Log.Info("admin request", F("method", r.Method), F("path", r.URL.Path), F(logKeyRemote, r.RemoteAddr))
+		handler(w, r)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, map[string]string{"error": msg})
+}
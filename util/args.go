@@ -0,0 +1,65 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Arguments of client messages are parsed by pure functions before the operation touches any state,
+// malformed arguments are rejected as invalid operations.
+
+// parseArgs splits data of client message to arguments, data must be printable UTF-8 text.
+func parseArgs(data []byte) ([]string, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("arguments are not valid text" + ArgSep + SrvErrInvalidOp)
+	}
+	for _, r := range string(data) {
+		if unicode.IsControl(r) {
+			return nil, fmt.Errorf("arguments contain control characters" + ArgSep + SrvErrInvalidOp)
+		}
+	}
+	return strings.Split(string(data), ArgSep), nil
+}
+
+// parseLoginArgs returns player name from arguments of login.
+func parseLoginArgs(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("wrong number of arguments")
+	}
+	if len(args[0]) == 0 {
+		return "", fmt.Errorf("name cannot be empty")
+	}
+	return args[0], nil
+}
+
+// parseJoinArgs returns game type and rules from arguments of join.
+func parseJoinArgs(args []string) (int, Rules, error) {
+	gameType, err := parseGameType(args[0])
+	if err != nil {
+		return 0, Rules{}, fmt.Errorf(err.Error() + ArgSep + SrvErrInvalidOp)
+	}
+	rules, err := parseRules(gameType, args[1:])
+	if err != nil {
+		return 0, Rules{}, fmt.Errorf(err.Error() + ArgSep + SrvErrInvalidOp)
+	}
+	return gameType, rules, nil
+}
+
+// parseMoveArgs returns coordinates and symbol (NoSymbol if not given) from arguments of move.
+func parseMoveArgs(args []string) (int, int, int, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return 0, 0, 0, fmt.Errorf("wrong number of arguments" + ArgSep + SrvErrInvalidOp)
+	}
+	values := []int{0, 0, NoSymbol}
+	for i, arg := range args {
+		value, err := strconv.Atoi(arg)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("couldnt parse arg" + ArgSep + SrvErrInvalidOp)
+		}
+		values[i] = value
+	}
+	return values[0], values[1], values[2], nil
+}
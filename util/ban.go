@@ -0,0 +1,284 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ban kinds
+const (
+	BanKindName = "name"
+	BanKindIP   = "ip" // single IP address or CIDR range
+)
+
+// Ban is one entry of the ban list.
+type Ban struct {
+	Kind    string    `json:"kind"`
+	Target  string    `json:"target"` // name, IP address or CIDR range
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // zero means permanent ban
+}
+
+// BanList holds banned player names and IP ranges and persists them to a file.
+type BanList struct {
+	bans  []Ban
+	kicks map[string][]time.Time // recent invalid operation kicks by IP address
+	path  string                 // file the bans are persisted to, empty means no persistence
+	mu    sync.Mutex
+}
+
+var bans = NewBanList("") //bans checked on accept and login
+
+func NewBanList(path string) *BanList {
+	return &BanList{bans: make([]Ban, 0), kicks: make(map[string][]time.Time), path: path}
+}
+
+// LoadBans replaces server ban list with bans persisted in file at path, missing file means no bans.
+// Later changes are persisted to the same file.
+func LoadBans(path string) error {
+	list := NewBanList(path)
+	err := list.Reload()
+	if err != nil {
+		return err
+	}
+	bans = list
+	return nil
+}
+
+// Reload reads bans from the file again (after manual edit).
+func (b *BanList) Reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		b.bans = make([]Ban, 0)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	loaded := make([]Ban, 0)
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return fmt.Errorf("invalid ban file %s: %v", b.path, err)
+	}
+	for _, ban := range loaded {
+		if err := validateBan(ban); err != nil {
+			return fmt.Errorf("invalid ban file %s: %v", b.path, err)
+		}
+	}
+	b.bans = loaded
+	return nil
+}
+
+// Add adds ban replacing existing ban of the same target and persists the list.
+// Duration 0 means permanent ban.
+func (b *BanList) Add(kind string, target string, reason string, duration time.Duration) (Ban, error) {
+	ban := Ban{Kind: kind, Target: target, Reason: reason, Created: Now()}
+	if duration > 0 {
+		ban.Expires = ban.Created.Add(duration)
+	}
+	if err := validateBan(ban); err != nil {
+		return Ban{}, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeUnlocked(kind, target)
+	b.bans = append(b.bans, ban)
+	return ban, b.save()
+}
+
+// Remove removes ban of the target and persists the list, it returns false if there was no such ban.
+func (b *BanList) Remove(kind string, target string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.removeUnlocked(kind, target) {
+		return false, nil
+	}
+	return true, b.save()
+}
+
+func (b *BanList) removeUnlocked(kind string, target string) bool {
+	for i, ban := range b.bans {
+		if ban.Kind == kind && ban.Target == target {
+			b.bans = append(b.bans[:i], b.bans[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List returns active bans.
+func (b *BanList) List() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pruneExpired()
+	result := make([]Ban, len(b.bans))
+	copy(result, b.bans)
+	return result
+}
+
+// IsNameBanned returns true if player name is banned.
+func (b *BanList) IsNameBanned(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pruneExpired()
+	for _, ban := range b.bans {
+		if ban.Kind == BanKindName && ban.Target == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIPBanned returns true if IP address is banned or lies in a banned range.
+func (b *BanList) IsIPBanned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pruneExpired()
+	for _, ban := range b.bans {
+		if ban.Kind == BanKindIP && getBanRange(ban.Target).Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordInvalidOpKick remembers that client from ip was kicked for invalid operations.
+// After MaxInvalidOpKicks kicks within InvalidOpKickWindow seconds the ip is banned for AutoBanSeconds,
+// it returns true in that case.
+func (b *BanList) RecordInvalidOpKick(ip net.IP) (bool, error) {
+	key := ip.String()
+	now := Now()
+	b.mu.Lock()
+	recent := make([]time.Time, 0, MaxInvalidOpKicks)
+	for _, t := range b.kicks[key] {
+		if now.Sub(t) < time.Second*InvalidOpKickWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < MaxInvalidOpKicks {
+		b.kicks[key] = recent
+		b.mu.Unlock()
+		return false, nil
+	}
+	delete(b.kicks, key)
+	b.mu.Unlock()
+	_, err := b.Add(BanKindIP, key, "too many invalid operations", time.Second*AutoBanSeconds)
+	return true, err
+}
+
+// pruneExpired removes expired bans, caller must hold b.mu.
+// Removed bans are not persisted immediately, the file is rewritten on next change.
+func (b *BanList) pruneExpired() {
+	now := Now()
+	active := b.bans[:0]
+	for _, ban := range b.bans {
+		if ban.Expires.IsZero() || ban.Expires.After(now) {
+			active = append(active, ban)
+		}
+	}
+	b.bans = active
+}
+
+// save writes bans to the file, caller must hold b.mu.
+func (b *BanList) save() error {
+	b.pruneExpired()
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(b.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	//write to temporary file first so the ban file is never half written
+	tmp := b.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// validateBan checks kind and target of the ban.
+func validateBan(ban Ban) error {
+	switch ban.Kind {
+	case BanKindName:
+		if ban.Target == "" {
+			return fmt.Errorf("empty name")
+		}
+	case BanKindIP:
+		if getBanRange(ban.Target) == nil {
+			return fmt.Errorf("invalid ip or cidr %s", ban.Target)
+		}
+	default:
+		return fmt.Errorf("unknown ban kind %s", ban.Kind)
+	}
+	return nil
+}
+
+// getBanRange parses IP address or CIDR range, single address is a range with full mask.
+func getBanRange(target string) *net.IPNet {
+	if _, ipNet, err := net.ParseCIDR(target); err == nil {
+		return ipNet
+	}
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// parseBanDuration parses ban duration like 30m or 2h, empty duration means permanent ban.
+func parseBanDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %s", value)
+	}
+	return duration, nil
+}
+
+// getBanKind returns ip for IP address or CIDR targets and name otherwise.
+func getBanKind(target string) string {
+	if getBanRange(target) != nil {
+		return BanKindIP
+	}
+	return BanKindName
+}
+
+// IsAddrBanned returns true if IP address of remote address of accepted connection is banned.
+func IsAddrBanned(addr net.Addr) bool {
+	ip := getAddrIP(addr)
+	return ip != nil && bans.IsIPBanned(ip)
+}
+
+// getAddrIP returns IP address of network address or nil if it has none.
+func getAddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,163 @@
+package util
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timing logic of the server tells time by the server clock: ping times, liveness, heartbeat and grace deadlines,
+// rate limits, bans and sessions. Tests replace it with FakeClock and advance it instead of waiting.
+// Network deadlines, session file locks, log timestamps, certificates and durations in metrics stay
+// on the system clock, they are compared with time of the operating system or other processes.
+
+// Clock tells time and creates timers.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single timer of Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{timer: time.NewTimer(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+var currentClock atomic.Value
+
+func init() {
+	currentClock.Store(clockHolder{realClock{}})
+}
+
+// clockHolder keeps clocks of different types in currentClock.
+type clockHolder struct {
+	clock Clock
+}
+
+// NewRealClock returns the system clock.
+func NewRealClock() Clock {
+	return realClock{}
+}
+
+// SetClock replaces the server clock, deadlines of watched players are recomputed with it.
+func SetClock(clock Clock) {
+	currentClock.Store(clockHolder{clock})
+	liveness.wakeUp()
+}
+
+// getClock returns the server clock.
+func getClock() Clock {
+	return currentClock.Load().(clockHolder).clock
+}
+
+// Now returns current time of the server clock.
+func Now() time.Time {
+	return getClock().Now()
+}
+
+// FakeClock is a manual clock, its time moves only when it is advanced.
+type FakeClock struct {
+	now    time.Time
+	timers []*fakeTimer //pending timers ordered by creation
+	mu     sync.Mutex
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	c     chan time.Time
+}
+
+// NewFakeClock returns manual clock starting at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{clock: c, when: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer
+	}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock by d and fires the timers that expired.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, v := range c.timers {
+		if v.when.After(c.now) {
+			pending = append(pending, v)
+			continue
+		}
+		v.c <- c.now
+	}
+	c.timers = pending
+}
+
+// Timers returns number of pending timers, tests use it to wait until a goroutine waits on the clock.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, v := range t.clock.timers {
+		if v == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// fired returns true if the channel has a value ready.
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	after := clock.After(time.Second)
+	timer := clock.NewTimer(2 * time.Second)
+	stopped := clock.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("pending timer not stopped")
+	}
+
+	clock.Advance(time.Second)
+	if !fired(after) || fired(timer.C()) || fired(stopped.C()) {
+		t.Error("only the timer of one second should fire after one second")
+	}
+	clock.Advance(time.Second)
+	if !fired(timer.C()) {
+		t.Error("timer did not fire after two seconds")
+	}
+	if now := clock.Now(); !now.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("clock shows %v, expected two seconds after start", now)
+	}
+	if clock.Timers() != 0 {
+		t.Errorf("%d timers pending, expected none", clock.Timers())
+	}
+}
+
+func TestTemporaryBanExpires(t *testing.T) {
+	clock := useFakeClock(t)
+	list := NewBanList("")
+	if _, err := list.Add(BanKindName, "expiring", "test", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute - time.Second)
+	if !list.IsNameBanned("expiring") {
+		t.Error("ban expired early")
+	}
+	clock.Advance(time.Second)
+	if list.IsNameBanned("expiring") {
+		t.Error("ban did not expire")
+	}
+}
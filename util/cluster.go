@@ -0,0 +1,245 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nodes of a cluster share a session store (see session.go) and match players across nodes.
+// A player joining a game on a node without a matching waiting game is moved to a peer node that has one:
+// the node logs the player out, logs it in on the peer, replays the join and relays frames between the client
+// and the peer from then on, so the game is owned by the peer and moves and broadcasts are relayed.
+// The connection to the peer is relayed the same way as a session handoff (see session.go) and a player
+// on a relayed connection is never moved again.
+// A player joining when no node has a waiting game gets a new game on its own node.
+//
+// Nodes ask each other for waiting games on the cluster listener with node messages, they are KIVUPS frames:
+//
+//	request:  nodeFindGameOpcode with join arguments
+//	response: nodeFindGameOpcode with ok and game address (-node-addr) of the node, or err
+
+const nodeFindGameOpcode = "101"
+
+// clusterConfig holds cluster listener addresses of the other nodes and their IP addresses.
+type clusterConfig struct {
+	peers   []string
+	peerIPs map[string]bool //connections relayed by peers are not limited per IP
+	mu      sync.Mutex
+}
+
+var cluster = &clusterConfig{peerIPs: make(map[string]bool)}
+
+// ConfigureCluster sets cluster listener addresses of the other nodes. It must be called before clients connect.
+func ConfigureCluster(peers []string) error {
+	peerIPs := make(map[string]bool)
+	for _, peer := range peers {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			return fmt.Errorf("invalid peer address %s", peer)
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return fmt.Errorf("could not resolve peer %s: %v", peer, err)
+		}
+		for _, ip := range ips {
+			peerIPs[ip.String()] = true
+		}
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.peers = peers
+	cluster.peerIPs = peerIPs
+	return nil
+}
+
+// getPeers returns cluster listener addresses of the other nodes.
+func getPeers() []string {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	return cluster.peers
+}
+
+// isPeerIP returns true if ip is address of another node.
+func isPeerIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	return cluster.peerIPs[ip.String()]
+}
+
+// ServeCluster answers node messages of the other nodes on addr.
+func ServeCluster(addr string) error {
+	l, err := net.Listen(ConnType, addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	Log.Info("serving cluster", F("address", l.Addr().String()))
+	return serveNodes(l)
+}
+
+// serveNodes answers node messages of connections accepted by l.
+func serveNodes(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handleNode(c)
+	}
+}
+
+// handleNode answers node messages of one connection, connections not coming from a peer node are closed.
+func handleNode(c net.Conn) {
+	node := &connTransport{conn: c, maxDataLen: MaxDataLen}
+	defer node.Close()
+	if !isPeerIP(getAddrIP(c.RemoteAddr())) {
+		Log.Warn("rejected node connection from unknown address", F(logKeyRemote, c.RemoteAddr().String()))
+		return
+	}
+	for {
+		node.SetReadDeadline(time.Now().Add(time.Second * MaxSecondsBeforeDisconnect))
+		frame, err := node.ReadFrame()
+		if _, ok := err.(*frameError); ok {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		response := createOpCode(frame.Opcode, false, "unknown opcode")
+		if frame.Opcode == nodeFindGameOpcode {
+			if nodeAddr != "" && hasWaitingGame(strings.Split(string(frame.Data), ArgSep)) {
+				response = createOpCode(frame.Opcode, true, nodeAddr)
+			} else {
+				response = createOpCode(frame.Opcode, false, "no waiting game")
+			}
+		}
+		node.SetWriteDeadline(time.Now().Add(time.Second * WriteTimeout))
+		if _, err := sendMsg(node, response, 0); err != nil {
+			return
+		}
+	}
+}
+
+// hasWaitingGame returns true if a game of the type and rules from join arguments waits for players.
+func hasWaitingGame(args []string) bool {
+	gameType, rules, err := parseJoinArgs(args)
+	if err != nil {
+		return false
+	}
+	gameListMutex.Lock()
+	defer gameListMutex.Unlock()
+	for _, v := range availableGamesList {
+		if v.gameType == gameType && v.GetRules() == rules && v.GetState() == WaitingForPlayersReady && !v.IsFull() {
+			return true
+		}
+	}
+	return false
+}
+
+// findRemoteGame returns game address of a peer node with a waiting game matching join arguments, empty if there is none.
+func findRemoteGame(join Frame) string {
+	for _, peer := range getPeers() {
+		conn, err := net.DialTimeout(ConnType, peer, time.Second*WriteTimeout)
+		if err != nil {
+			Log.Warn("could not reach peer node", F("node", peer), F(logKeyError, err))
+			continue
+		}
+		node := &connTransport{conn: conn, maxDataLen: MaxDataLen}
+		setNodeDeadline(node, time.Now().Add(time.Second*WriteTimeout))
+		response, err := requestNode(node, Frame{Opcode: nodeFindGameOpcode, Data: join.Data})
+		node.Close()
+		if err != nil {
+			Log.Warn("could not ask peer node for game", F("node", peer), F(logKeyError, err))
+			continue
+		}
+		args := strings.Split(string(response.Data), ArgSep)
+		if args[0] == ClientMsgOk && len(args) == 2 {
+			return args[1]
+		}
+	}
+	return ""
+}
+
+// setNodeDeadline sets read and write deadline of connection to another node.
+func setNodeDeadline(node Transport, t time.Time) {
+	node.SetReadDeadline(t)
+	node.SetWriteDeadline(t)
+}
+
+// requestNode sends frame and returns the first received frame with the same opcode.
+func requestNode(node Transport, frame Frame) (Frame, error) {
+	if err := node.WriteFrame(frame); err != nil {
+		return Frame{}, err
+	}
+	for {
+		response, err := node.ReadFrame()
+		if _, ok := err.(*frameError); ok {
+			continue
+		}
+		if err != nil {
+			return Frame{}, err
+		}
+		if response.Opcode == frame.Opcode {
+			return response, nil
+		}
+	}
+}
+
+// connectGameOwner moves the player joining a game to a peer node with a matching waiting game.
+// It returns connection to the peer with the player logged in and the join replayed, nil if the player stays.
+func connectGameOwner(player *Player, join Frame) Transport {
+	if nodeAddr == "" || len(getPeers()) == 0 {
+		return nil
+	}
+	args := strings.Split(string(join.Data), ArgSep)
+	stateMutex.Lock()
+	movable := player.Id != 0 && player.Connected && player.Status == InLobby && findGame(player) == nil && !hasWaitingGame(args)
+	client := player.Conn.RemoteAddr()
+	name := player.Name
+	version := player.GetProtocolVersion()
+	capabilities := getCapabilityList(player.Capabilities)
+	stateMutex.Unlock()
+	if !movable {
+		return nil
+	}
+	addr := findRemoteGame(join)
+	if addr == "" {
+		return nil
+	}
+
+	owner, err := dialNode(addr, client)
+	if err != nil {
+		Log.Warn("could not reach node with waiting game", F("node", addr), F(logKeyError, err))
+		return nil
+	}
+	_, err = requestNode(owner, Frame{Opcode: MsgHelloOpcode, Data: []byte(fmt.Sprint(version) + ArgSep + capabilities)})
+	if err == nil {
+		var response Frame
+		response, err = requestNode(owner, Frame{Opcode: MsgLoginOpcode, Data: []byte(name)})
+		if err == nil && !strings.HasPrefix(string(response.Data), ClientMsgOk) {
+			err = fmt.Errorf("login refused: %s", response.Data)
+		}
+	}
+	if err != nil {
+		Log.Warn("could not move player to node with waiting game", F("node", addr), F(logKeyError, err))
+		owner.Close()
+		return nil
+	}
+	setNodeDeadline(owner, time.Time{})
+
+	stateMutex.Lock()
+	playerLog(player).Info("player moved to node with waiting game", F("node", addr))
+	playerDisconnected(player)
+	stateMutex.Unlock()
+	if err := owner.WriteFrame(join); err != nil {
+		owner.Close()
+		return nil
+	}
+	return owner
+}
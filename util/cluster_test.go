@@ -0,0 +1,99 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// startClusterNode serves node messages of this process on loopback.
+func startClusterNode(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveNodes(l)
+	return l.Addr().String()
+}
+
+func configureTestCluster(t *testing.T, addr string, peers ...string) {
+	ConfigureSessions(NewMemorySessionStore(), addr, "")
+	if err := ConfigureCluster(peers); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ConfigureSessions(NewMemorySessionStore(), "", "")
+		ConfigureCluster(nil)
+	})
+}
+
+func TestClusterFindsWaitingGame(t *testing.T) {
+	configureTestCluster(t, "127.0.0.1:9999", startClusterNode(t))
+	rules, _ := parseRules(ClassicGame, nil)
+	game := createGame(ClassicGame, rules)
+	defer removeGame(getGameId(game))
+	game.Join(&Player{Id: 1000, Name: "waiting"})
+
+	if addr := findRemoteGame(Frame{Opcode: MsgJoinOpcode, Data: []byte(GameTypeClassic)}); addr != "127.0.0.1:9999" {
+		t.Errorf("found game at %q, expected game address of the node", addr)
+	}
+	join := Frame{Opcode: MsgJoinOpcode, Data: []byte(GameTypeClassic + ArgSep + RuleMisere)}
+	if addr := findRemoteGame(join); addr != "" {
+		t.Errorf("found game with other rules at %q", addr)
+	}
+}
+
+func TestClusterMovesPlayerToWaitingGame(t *testing.T) {
+	gameAddr := startFakeNode(t, func(frame Frame) []Frame {
+		switch frame.Opcode {
+		case MsgJoinOpcode:
+			return []Frame{
+				{Opcode: MsgJoinOpcode, Data: []byte(ClientMsgOk + ArgSep + "joined game 7")},
+				{Opcode: MsgGameStartedOpcode, Data: []byte(ClientMsgOk + ArgSep + "remote")},
+			}
+		default:
+			return []Frame{{Opcode: frame.Opcode, Data: []byte(ClientMsgOk + ArgSep + string(frame.Data))}}
+		}
+	})
+	peer := startFakeNode(t, func(frame Frame) []Frame {
+		return []Frame{{Opcode: frame.Opcode, Data: []byte(ClientMsgOk + ArgSep + gameAddr)}}
+	})
+	configureTestCluster(t, "127.0.0.1:9999", peer)
+
+	c := connectTestClient(t)
+	defer c.conn.Close()
+	c.login("mover")
+	c.send(MsgJoinOpcode, GameTypeClassic)
+	if response := string(c.expect(MsgJoinOpcode).Data); response != "ok;joined game 7" {
+		t.Errorf("join response %q, expected response of the node with waiting game", response)
+	}
+	if response := string(c.expect(MsgGameStartedOpcode).Data); response != "ok;remote" {
+		t.Errorf("game started %q, expected relayed message", response)
+	}
+	if players.GetPlayerByName("mover") != nil {
+		t.Error("moved player still logged in on its node")
+	}
+}
+
+func TestClusterRejectsUnknownNode(t *testing.T) {
+	configureTestCluster(t, "127.0.0.1:9999")
+	conn, err := net.Dial("tcp", startClusterNode(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &connTransport{conn: conn, maxDataLen: MaxDataLen}
+	defer node.Close()
+	if response, err := requestNode(node, Frame{Opcode: nodeFindGameOpcode, Data: []byte(GameTypeClassic)}); err == nil {
+		t.Errorf("node not configured as peer got response %q", response.Data)
+	}
+}
+
+func TestClientCannotNegotiateRelayed(t *testing.T) {
+	c := connectTestClient(t)
+	defer c.conn.Close()
+	c.send(MsgHelloOpcode, fmt.Sprint(ProtocolVersion), "relayed"+capSep+CapRules)
+	if response := string(c.expect(MsgHelloOpcode).Data); response != ClientMsgOk+ArgSep+fmt.Sprint(ProtocolVersion)+ArgSep+CapRules {
+		t.Errorf("hello response %q, expected only rules capability", response)
+	}
+}
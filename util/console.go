@@ -0,0 +1,211 @@
+package util
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const consolePrompt = "> "
+
+const consoleHelp = `commands:
+  players                 list logged in players
+  games                   list games
+  kick <name>             disconnect player
+  ban <name|ip|cidr> [duration]
+                          ban player name, IP address or range and kick matching players,
+                          duration like 30m or 2h, permanent if missing
+  unban <name|ip|cidr>    remove ban
+  bans                    list active bans
+  bans reload             reload bans from the ban file
+  say <msg>               send status message to everyone
+  end game <id>           end game without result
+  dump game <id>          print game as JSON
+  set pingtime <seconds>  change expected time between pings
+  set loglevel <level>    change log verbosity (debug, info, warn, error)
+  help                    show this help
+  quit                    close console`
+
+// ServeConsole serves line-oriented admin console on unix domain socket at path.
+// The socket is accessible only by the owner of the server process.
+func ServeConsole(path string) error {
+	os.Remove(path) //stale socket from previous run
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		return err
+	}
+	Log.Info("serving admin console", F("path", path))
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handleConsole(c)
+	}
+}
+
+// handleConsole executes commands read from console connection line by line.
+func handleConsole(c net.Conn) {
+	defer c.Close()
+	Log.Info("console session started")
+	scanner := bufio.NewScanner(c)
+	fmt.Fprint(c, consolePrompt)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "quit" || line == "exit" {
+			break
+		}
+		if line != "" {
+			Log.Info("console command", F("command", line))
+			fmt.Fprintln(c, executeConsoleCommand(line))
+		}
+		fmt.Fprint(c, consolePrompt)
+	}
+	Log.Info("console session ended")
+}
+
+// executeConsoleCommand executes one console command and returns its output.
+func executeConsoleCommand(line string) string {
+	fields := strings.Fields(line)
+	args := fields[1:]
+	switch fields[0] {
+	case "help":
+		return consoleHelp
+	case "players":
+		var b strings.Builder
+		fmt.Fprintf(&b, "%-6s %-16s %-22s %-6s %-9s %-8s %-6s %s", "ID", "NAME", "REMOTE", "STATUS", "CONNECTED", "PING AGE", "RTT MS", "GAME")
+		for _, v := range listPlayers() {
+			fmt.Fprintf(&b, "\n%-6d %-16s %-22s %-6s %-9t %-8.1f %-6d %d", v.Id, v.Name, v.Remote, v.Status, v.Connected, v.LastPingAgeSecs, v.RttMs, v.GameId)
+		}
+		return b.String()
+	case "games":
+		var b strings.Builder
+		fmt.Fprintf(&b, "%-6s %-9s %-24s %-8s %s", "ID", "TYPE", "RULES", "STATE", "SEATS")
+		for _, v := range listGames() {
+			seats := make([]string, 0, len(v.Seats))
+			for _, seat := range v.Seats {
+				seats = append(seats, fmt.Sprintf("%d:%s", seat.Seat, seat.Name))
+			}
+			fmt.Fprintf(&b, "\n%-6d %-9s %-24s %-8s %s", v.Id, v.Type, v.Rules, v.State, strings.Join(seats, " "))
+		}
+		return b.String()
+	case "kick":
+		if len(args) != 1 {
+			return "usage: kick <name>"
+		}
+		if err := kickPlayer(args[0], "kicked by admin"); err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok"
+	case "ban":
+		if len(args) != 1 && len(args) != 2 {
+			return "usage: ban <name|ip|cidr> [duration]"
+		}
+		duration := time.Duration(0)
+		if len(args) == 2 {
+			var err error
+			if duration, err = parseBanDuration(args[1]); err != nil {
+				return "error: " + err.Error()
+			}
+		}
+		result, err := banTarget(args[0], "banned by admin", duration)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return result
+	case "unban":
+		if len(args) != 1 {
+			return "usage: unban <name|ip|cidr>"
+		}
+		if err := unbanTarget(args[0]); err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok"
+	case "bans":
+		if len(args) == 1 && args[0] == "reload" {
+			if err := bans.Reload(); err != nil {
+				return "error: " + err.Error()
+			}
+			return "ok"
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "%-5s %-20s %-25s %s", "KIND", "TARGET", "EXPIRES", "REASON")
+		for _, v := range bans.List() {
+			expires := "never"
+			if !v.Expires.IsZero() {
+				expires = v.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(&b, "\n%-5s %-20s %-25s %s", v.Kind, v.Target, expires, v.Reason)
+		}
+		return b.String()
+	case "say":
+		if len(args) == 0 {
+			return "usage: say <msg>"
+		}
+		sent, err := broadcastStatus(strings.Join(args, " "))
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return fmt.Sprintf("sent to %d player(s)", sent)
+	case "end", "dump":
+		if len(args) != 2 || args[0] != "game" {
+			return "usage: " + fields[0] + " game <id>"
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "error: invalid game id"
+		}
+		if fields[0] == "end" {
+			if err := endGame(id, "Ended by admin"); err != nil {
+				return "error: " + err.Error()
+			}
+			return "ok"
+		}
+		game := findGameById(id)
+		if game == nil {
+			return "error: game not found"
+		}
+		dump, _ := json.MarshalIndent(getGameInfo(game), "", "  ")
+		return string(dump)
+	case "set":
+		if len(args) != 2 {
+			return "usage: set pingtime <seconds> | set loglevel <level>"
+		}
+		return executeConsoleSet(args[0], args[1])
+	default:
+		return "unknown command, type help"
+	}
+}
+
+// executeConsoleSet changes runtime setting.
+func executeConsoleSet(name string, value string) string {
+	switch name {
+	case "pingtime":
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return "error: invalid number"
+		}
+		if err := setPingTime(seconds); err != nil {
+			return "error: " + err.Error()
+		}
+	case "loglevel":
+		level, err := ParseLogLevel(value)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		Log.SetLevel(level)
+	default:
+		return "error: unknown setting " + name
+	}
+	return "ok"
+}
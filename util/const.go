@@ -6,12 +6,29 @@ const (
 	ConnType                   = "tcp"
 	MaxDataLen                 = 128
 	MaxMsgDataLen              = 4
-	MaxClients                 = 4
-	ArgSep                     = ";" //argument separator in messages
-	MaxInvalidOp               = 5   //max number of invalid operations before disconnecting client
-	PingTime                   = 3   //time between pings
-	MaxNoPingReceived          = 3   //if 3 pings are not received, client is disconnected
-	MaxSecondsBeforeDisconnect = 80  //time before completely disconnecting client, must be bigger than PingTime*MaxNoPingReceived
+	MaxClients                 = 10000 //default max number of logged in players
+	MaxConns                   = 20000 //default max number of open connections
+	ArgSep                     = ";"   //argument separator in messages
+	MaxInvalidOp               = 5     //max number of invalid operations before disconnecting client
+	MaxInvalidOpKicks          = 3     //max number of invalid operation kicks of one IP before temporary ban
+	InvalidOpKickWindow        = 600   //seconds in which the kicks are counted
+	AutoBanSeconds             = 900   //duration of temporary ban after too many kicks
+	MaxConnsPerIP              = 8     //default max number of open connections from one IP address
+	MaxUnauthConns             = 32    //max number of open connections without logged in player
+	LoginTimeout               = 30    //seconds a connection may stay open without logging in
+	OutboundQueueLen           = 64    //default number of messages queued for sending to one client
+	WriteTimeout               = 5     //default seconds to send one message before the client is disconnected
+	PingTime                   = 3     //time between pings
+	MaxNoPingReceived          = 3     //if 3 pings are not received, client is disconnected
+	MaxSecondsBeforeDisconnect = 80    //time before completely disconnecting client, must be bigger than PingTime*MaxNoPingReceived
+
+	//rate limits (messages per second) and bursts per connection by opcode class
+	PingRateLimit  = 2
+	PingRateBurst  = 5
+	LoginRateLimit = 0.5
+	LoginRateBurst = 3
+	GameRateLimit  = 10
+	GameRateBurst  = 20
 
 	//Size of message (msgdatalen) is a 4 digit number -> 0 ... 9999 bytes
 	// maxmsdgdatalen says how large data part is
@@ -20,25 +37,31 @@ const (
 	//magic word
 	MsgMagic = "KIVUPS" //magic word needed
 
+	//magic word of JSON messages, the first message of a connection selects its format
+	MsgMagicJSON = "KIVJSN"
+
 	//Login operation arguments: string, client response is OK and board size or ERR
 	MsgLoginOpcode = "001"
 
-	//Join operation has no arguments, client response is OK or ERR
+	//Join operation has optional arguments game type (classic or ultimate) and rules (misere, wild, seats=N, size=N, line=N,
+	//grace=N, drops=N, timeout=forfeit|abort|draw, claim), client response is OK or ERR
 	MsgJoinOpcode = "002"
 
-	//Move operation arguments: int;int, client response contains board in parsable format
+	//Move operation arguments: int;int and optional symbol (seat number 1..N, only in wild game), client response contains board in parsable format
+	//In ultimate game the coordinates are on the whole 9x9 board and the board is followed by active sub-board and macro board
 	MsgMoveOpcode = "003"
 
 	//Operation play again has no arguments
 	MsgPlayAgainOpcode = "004"
 
-	//Game started has no arguments, client response contains name of the other player
+	//Game started has no arguments, client response contains names of the other players (separated by ","),
+	//followed by game type and rules for clients with rules capability
 	MsgGameStartedOpcode = "005"
 
 	//Return to start has no arguments, returns OK but returns ERR and GameGone if game does not exist anymore
 	MsgReturnToStartOpcode = "006"
 
-	//Server doesnt receive this, only sends it to client with winner name (or draw)
+	//Server doesnt receive this, only sends it to client with winner name (names separated by "," if the win is shared, or draw)
 	MsgGameOverOpcode = "007"
 
 	//unused
@@ -64,6 +87,20 @@ const (
 
 	//send some status info to client
 	MsgStatusOpcode = "015"
+
+	//Hello operation arguments: protocol version and optional capabilities (separated by ","), must be sent before login,
+	//client response is OK with protocol version and accepted capabilities or ERR (connection is closed on incompatible version)
+	//Clients that do not send hello use MinProtocolVersion without capabilities
+	MsgHelloOpcode = "016"
+
+	//Server sends heartbeat to clients with heartbeat capability every ping time, arguments: sequence number and round-trip times
+	//of the other players in the game (name=milliseconds separated by ","), client echoes the sequence number, server does not respond.
+	//The echo counts as a ping and measures round-trip time of the client
+	MsgHeartbeatOpcode = "017"
+
+	//Claim operation has no arguments, player may claim the win while an opponent is disconnected in game with claim rule,
+	//client response is ERR, on success game over is sent to the players instead
+	MsgClaimOpcode = "018"
 )
 
 // info for client that their msg was not valid and the server didnt like it so it will kick them if they keep sending invalid msgs
@@ -71,6 +108,25 @@ const (
 	SrvErrInvalidOp = "criticalerror"
 )
 
+// reasons of rejected connections and messages sent as last argument of error
+const (
+	SrvErrRateLimited         = "ratelimited"         //client sends messages too fast, message was dropped
+	SrvErrTooManyConns        = "toomanyconnections"  //too many connections from client IP address
+	SrvErrServerBusy          = "serverbusy"          //too many connections waiting for login
+	SrvErrLoginTimeout        = "logintimeout"        //client did not log in in time
+	SrvErrIncompatibleVersion = "incompatibleversion" //protocol version of client is not supported
+	SrvErrInvalidFrame        = "invalidframe"        //message could not be decoded, counts as invalid operation or closes the connection if the next message cannot be found
+)
+
+// protocol versions and capabilities (hello operation)
+const (
+	ProtocolVersion    = 2           //newest supported version
+	MinProtocolVersion = 1           //oldest supported version, used by clients without hello
+	CapRules           = "rules"     //game started carries game type and rules
+	CapHeartbeat       = "heartbeat" //server sends heartbeats, client echoes them
+	capSep             = ","         //separates capabilities
+)
+
 // extra info (data) for opcodes (client messages)
 const (
 	ClientMsgGameGone = "gamegone"
@@ -90,6 +146,45 @@ const (
 	ClientMsgRecovery_InGame_GameOver       = "recovery_ingame_gameover"
 )
 
+// game types (argument of join operation)
+const (
+	GameTypeClassic  = "classic"
+	GameTypeUltimate = "ultimate"
+)
+
+// rule options (arguments of join operation after game type)
+const (
+	RuleMisere   = "misere"   //whoever completes a line loses
+	RuleWild     = "wild"     //each move chooses which symbol to place
+	RuleStandard = "standard" //announced when no rule option is active
+	RuleSeats    = "seats="   //number of players
+	RuleSize     = "size="    //board size
+	RuleLine     = "line="    //symbols in a row needed to win
+	RuleGrace    = "grace="   //seconds the game waits for a disconnected player, by default until the player is removed
+	RuleDrops    = "drops="   //disconnects allowed per player and game, the next one ends the game, by default unlimited
+	RuleTimeout  = "timeout=" //outcome of a game ended because of disconnected player (forfeit, abort or draw)
+	RuleClaim    = "claim"    //player waiting for disconnected opponent may claim the win
+	ruleSep      = ","        //separates rules announced in game started
+)
+
+// outcomes of a game ended because of disconnected player (timeout rule)
+const (
+	TimeoutForfeit = "forfeit" //disconnected player loses, the other players share the win (default)
+	TimeoutAbort   = "abort"   //game ends without result
+	TimeoutDraw    = "draw"    //game ends as a draw
+)
+
+// reasons of game end recorded in the game
+const (
+	EndReasonLine       = "line"       //line completed
+	EndReasonFull       = "full"       //board full, draw
+	EndReasonAdmin      = "admin"      //ended by admin
+	EndReasonDisconnect = "disconnect" //player removed from server (timeout, kick)
+	EndReasonGrace      = "grace"      //disconnected player did not reconnect in grace period
+	EndReasonDrops      = "drops"      //player disconnected too many times
+	EndReasonClaim      = "claim"      //waiting player claimed the win
+)
+
 // client staus
 const (
 	InLobby      = 1
@@ -102,14 +197,32 @@ const (
 	colSep           = "|"
 	rowSep           = "--"
 	defaultBoardSize = 3
+	//Ultimate game
+	boardPartSep         = "@" //separates board, active sub-board and macro board
+	ultimateSubBoardSize = 3   //size of sub-board and of macro board
+	anySubBoard          = -1  //next move can be played in any sub-board
+	drawnSubBoard        = -1  //marks drawn sub-board in macro board
 	//Game state
-	WaitingForPlayersReady  = 1
-	WaitingForPlayerOneMove = 2
-	WaitingForPlayerTwoMove = 3
-	GameOver                = 4
+	WaitingForPlayersReady = 1
+	WaitingForMove         = 2 //seat on turn is kept in the game
+	GameOver               = 4
 	//Game over state
-	NotOver      = 5
-	PlayerOneWin = 6
-	PlayerTwoWin = 7
-	Draw         = 8
+	NotOver = 5
+	Win     = 6 //single winner or players sharing the win (misère with more than two seats)
+	Draw    = 8
+	Aborted = 11 //game ended without result (e.g. by admin)
+	//Game type
+	ClassicGame  = 9
+	UltimateGame = 10
+	//Symbol chosen in move, symbol of seat N is N
+	NoSymbol = 0
+	SymbolX  = 1
+	SymbolO  = 2
+	//Seats
+	defaultSeats  = 2
+	maxSeats      = 4
+	maxBoardSize  = 10
+	maxDrops      = 10
+	minWinLength  = 3
+	ultimateSeats = 2
 )
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// Checks of the message parser run by go-fuzz targets (see fuzz_gofuzz.go) and by tests over the corpus
+// in testdata/fuzz, recorded from traffic of the Python client. A check panics when the parser breaks
+// its contract, inputs that parse return 1 so go-fuzz prefers them.
+
+// fuzzFrame decodes complete message, decoded message must encode back to the same bytes.
+func fuzzFrame(data []byte) int {
+	frame, err := decodeFrame(data)
+	if err != nil {
+		return 0
+	}
+	if !bytes.Equal(encodeFrame(frame), data) {
+		panic(fmt.Sprintf("frame %q decoded from %q", encodeFrame(frame), data))
+	}
+	return 1
+}
+
+// fuzzStream reads messages of one connection until it would be closed. Every message read, valid or not,
+// must consume exactly the bytes its header announced, so the following bytes are never misparsed.
+func fuzzStream(data []byte) int {
+	r := &countingReader{r: bytes.NewReader(data)}
+	format := int32(wireUnknown)
+	read := 0
+	for {
+		start := r.n
+		frame, err := readFrame(r, &format, MaxDataLen)
+		if _, ok := err.(*frameError); !ok && err != nil {
+			if !isStreamError(err) && err != io.EOF && err != io.ErrUnexpectedEOF {
+				panic(fmt.Sprintf("unexpected error %v", err))
+			}
+			break
+		}
+		msg := data[start:r.n]
+		if atomic.LoadInt32(&format) == wireJSON {
+			bodyLen, headerErr := parseJSONHeader(msg[:len(MsgMagicJSON)+MaxMsgDataLen])
+			if headerErr != nil || bodyLen != len(msg)-len(MsgMagicJSON)-MaxMsgDataLen {
+				panic(fmt.Sprintf("json message %q consumed differently than announced", msg))
+			}
+		} else if err != nil {
+			_, dataLen, headerErr := parseFrameHeader(msg[:MsgHeaderLen])
+			if headerErr != nil || dataLen != len(msg)-MsgHeaderLen {
+				panic(fmt.Sprintf("text message %q consumed differently than announced", msg))
+			}
+		} else if !bytes.Equal(encodeFrame(frame), msg) {
+			panic(fmt.Sprintf("text message %q read as %q, %v", msg, encodeFrame(frame), err))
+		}
+		if err == nil {
+			read++
+		}
+	}
+	if read > 0 {
+		return 1
+	}
+	return 0
+}
+
+// fuzzArgs parses data of client message as arguments of every operation.
+func fuzzArgs(data []byte) int {
+	args, err := parseArgs(data)
+	if err != nil {
+		return 0
+	}
+	if strings.Join(args, ArgSep) != string(data) {
+		panic(fmt.Sprintf("arguments %q split from %q", args, data))
+	}
+	parsed := 0
+	if _, err := parseLoginArgs(args); err == nil {
+		parsed = 1
+	}
+	if _, rules, err := parseJoinArgs(args); err == nil {
+		if rules.Seats < 2 || rules.BoardSize < rules.WinLength {
+			panic(fmt.Sprintf("invalid rules %+v parsed from %q", rules, data))
+		}
+		parsed = 1
+	}
+	if _, _, _, err := parseMoveArgs(args); err == nil {
+		parsed = 1
+	}
+	if _, _, err := negotiateProtocol(args); err == nil {
+		parsed = 1
+	}
+	return parsed
+}
+
+// countingReader counts bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
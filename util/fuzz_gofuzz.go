@@ -0,0 +1,24 @@
+//go:build gofuzz
+// +build gofuzz
+
+package util
+
+// Fuzz targets of the message parser for go-fuzz, built only with the gofuzz tag, e.g.:
+//
+//	go-fuzz-build -func FuzzStream ./util
+//	go-fuzz -bin util-fuzz.zip -workdir util/testdata/fuzz/stream
+
+// FuzzFrame decodes complete message, decoded message must encode back to the same bytes.
+func FuzzFrame(data []byte) int {
+	return fuzzFrame(data)
+}
+
+// FuzzStream reads messages of one connection until it would be closed.
+func FuzzStream(data []byte) int {
+	return fuzzStream(data)
+}
+
+// FuzzArgs parses data of client message as arguments of every operation.
+func FuzzArgs(data []byte) int {
+	return fuzzArgs(data)
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Runs fuzz checks over the corpus of their go-fuzz targets.
+
+func testFuzzCorpus(t *testing.T, target string, fuzz func([]byte) int) {
+	files, err := filepath.Glob(filepath.Join("testdata", "fuzz", target, "corpus", "*"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no corpus of %s: %v", target, err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fuzz(data)
+	}
+}
+
+func TestFuzzCorpus(t *testing.T) {
+	testFuzzCorpus(t, "frame", fuzzFrame)
+	testFuzzCorpus(t, "stream", fuzzStream)
+	testFuzzCorpus(t, "args", fuzzArgs)
+}
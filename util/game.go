@@ -8,19 +8,30 @@ import (
 )
 
 type TicTacToeGame struct {
+	id             int // unique id of the game, assigned when game is created by server
 	board          [][]int
-	players        [2]*Player
+	players        []*Player // seats of the game, empty seat has player with ID 0
 	gameState      int
-	gameOverState  int // depends on constants set in const.go
-	readyPlayerOne int // 0 = not ready, 1 = ready
-	readyPlayerTwo int // 0 = not ready, 1 = ready
-	moveCount      int // number of moves made
+	gameOverState  int     // depends on constants set in const.go
+	ready          []bool  // ready flag of each seat
+	turn           int     // seat that is on turn
+	startingSeat   int     // seat that starts the next game, 0 in the first game and 1 in every replay
+	winners        []int   // seats that won the game, all seats in case of draw
+	winLength      int     // number of symbols in a row needed to win
+	moveCount      int     // number of moves made
+	gameType       int     // ClassicGame or UltimateGame
+	macroBoard     [][]int // ultimate only, winner of each sub-board
+	activeSubBoard int     // ultimate only, sub-board the next move must be played in
+	rules          Rules   // rule options of the game
+	endReason      string  // reason of the game end, empty if not over
+	disconnects    []int   // disconnects of each seat in the current game
+	joinedIds      []int   // ids of players that joined the game, kept after they leave it
 	mu             sync.Mutex
 }
 
 // Join adds a player to the TicTacToeGame.
 // It returns an error if the game has already started or is over.
-// If the game is not full, the player is added to the first available slot.
+// If the game is not full, the player is added to the first available seat.
 // If the maximum number of players has been reached, an error is returned.
 func (g *TicTacToeGame) Join(player *Player) error {
 	g.mu.Lock()
@@ -29,39 +40,103 @@ func (g *TicTacToeGame) Join(player *Player) error {
 		return errors.New("game already started or over")
 	}
 	//check if game is full
-	if g.players[0].Id == 0 {
-		g.players[0] = player
-		g.readyPlayerOne = 1
-		return nil
+	for i, v := range g.players {
+		if v.Id == 0 {
+			g.players[i] = player
+			g.ready[i] = true
+			g.joinedIds = append(g.joinedIds, player.Id)
+			return nil
+		}
 	}
+	return errors.New("max number of players reached")
+}
 
-	if g.players[1].Id == 0 {
-		g.players[1] = player
-		g.readyPlayerTwo = 1
+// GetGameWinners returns players that won the game, all players in case of draw and nil if game is not over.
+func (g *TicTacToeGame) GetGameWinners() []*Player {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gameOverState == NotOver {
 		return nil
 	}
-	return errors.New("max number of players reached")
+	winners := make([]*Player, 0, len(g.winners))
+	for _, seat := range g.winners {
+		winners = append(winners, g.players[seat])
+	}
+	return winners
+}
+
+// GetGameResult returns result announced in game over message,
+// name of the winner, names of players sharing the win separated by ruleSep or Draw.
+func (g *TicTacToeGame) GetGameResult() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gameOverState == Draw {
+		return "Draw"
+	}
+	if g.gameOverState == Aborted {
+		return "Aborted"
+	}
+	names := make([]string, 0, len(g.winners))
+	for _, seat := range g.winners {
+		names = append(names, g.players[seat].Name)
+	}
+	return strings.Join(names, ruleSep)
 }
 
-func (g *TicTacToeGame) GetGameWinner() *Player {
-	if g.gameOverState == PlayerOneWin {
-		return g.players[0]
-	} else if g.gameOverState == PlayerTwoWin {
-		return g.players[1]
-	} else {
+// GetOtherPlayers returns the other players seated in the game.
+func (g *TicTacToeGame) GetOtherPlayers(player *Player) []*Player {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	others := make([]*Player, 0, len(g.players)-1)
+	for _, v := range g.players {
+		if v.Id != 0 && v.Id != player.Id {
+			others = append(others, v)
+		}
+	}
+	return others
+}
+
+// GetPlayers returns all seats of the game, empty seats included.
+func (g *TicTacToeGame) GetPlayers() []*Player {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	players := make([]*Player, len(g.players))
+	copy(players, g.players)
+	return players
+}
+
+// GetPlayerOnTurn returns the player that is on turn or nil if game is not in play.
+func (g *TicTacToeGame) GetPlayerOnTurn() *Player {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gameState != WaitingForMove {
 		return nil
 	}
+	return g.players[g.turn]
+}
+
+// HasPlayer returns true if player is seated in the game.
+func (g *TicTacToeGame) HasPlayer(player *Player) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.getSeat(player.Id) != -1
 }
 
-// GetOtherPlayer returns the other player in the game.
-func (g *TicTacToeGame) GetOtherPlayer(player *Player) *Player {
+// getJoinedIds returns ids of players that joined the game, including those that left it.
+func (g *TicTacToeGame) getJoinedIds() []int {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	if g.players[0].Id == player.Id {
-		return g.players[1]
-	} else {
-		return g.players[0]
+	return g.joinedIds
+}
+
+// getSeat returns seat of player with given ID or -1. Caller must hold g.mu.
+func (g *TicTacToeGame) getSeat(id int) int {
+	for i, v := range g.players {
+		if v.Id == id {
+			return i
+		}
 	}
+	return -1
 }
 
 // If player wants to play again after game is over, this function is called.
@@ -71,13 +146,11 @@ func (g *TicTacToeGame) PlayAgain(player Player) error {
 	if g.gameState != GameOver {
 		return errors.New("game not over")
 	}
-	if g.players[0].Id == player.Id {
-		g.readyPlayerOne = 1
-	} else if g.players[1].Id == player.Id {
-		g.readyPlayerTwo = 1
-	} else {
+	seat := g.getSeat(player.Id)
+	if seat == -1 {
 		return errors.New("player not in game")
 	}
+	g.ready[seat] = true
 	return nil
 }
 
@@ -85,15 +158,15 @@ func (g *TicTacToeGame) PlayAgain(player Player) error {
 func (g *TicTacToeGame) RemovePlayer(player *Player) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	if g.players[0].Id == player.Id {
-		*g.players[0] = Player{}
-	} else if g.players[1].Id == player.Id {
-		*g.players[1] = Player{}
+	if seat := g.getSeat(player.Id); seat != -1 {
+		*g.players[seat] = Player{}
 	}
 }
 
 // Handles a move from a player and sets the game state accordingly.
-func (g *TicTacToeGame) Move(player Player, x int, y int) error {
+// Symbol is the seat number (1..N) whose symbol is placed, it can be chosen only in wild game,
+// NoSymbol places the player's own symbol.
+func (g *TicTacToeGame) Move(player Player, x int, y int, symbol int) error {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	//check if game is over
@@ -108,55 +181,153 @@ func (g *TicTacToeGame) Move(player Player, x int, y int) error {
 	if g.board[x][y] != 0 {
 		return errors.New("field already occupied")
 	}
+	if g.gameType == UltimateGame {
+		if err := g.checkUltimateMove(x, y); err != nil {
+			return err
+		}
+	}
+	//check symbol, it can be chosen only in wild game
+	if symbol < NoSymbol || symbol > len(g.players) {
+		return errors.New("unknown symbol")
+	}
+	if symbol != NoSymbol && !g.rules.Wild {
+		return errors.New("symbol can be chosen only in wild game")
+	}
 	//check if player is allowed to move
-	if g.gameState == WaitingForPlayerOneMove && player.Id == g.players[0].Id {
-		g.board[x][y] = player.Id
-	} else if g.gameState == WaitingForPlayerTwoMove && player.Id == g.players[1].Id {
-		g.board[x][y] = player.Id
-	} else {
+	if g.gameState != WaitingForMove || player.Id != g.players[g.turn].Id {
 		return errors.New("not players turn")
 	}
+	//symbols are stored as ID of the player owning them, so the board format stays the same
+	placed := player.Id
+	if symbol != NoSymbol {
+		placed = g.players[symbol-1].Id
+	}
+	g.board[x][y] = placed
 	g.moveCount++
 
-	//change game state
-	if g.gameState == WaitingForPlayerOneMove {
-		g.gameState = WaitingForPlayerTwoMove
-	} else {
-		g.gameState = WaitingForPlayerOneMove
+	//pass turn to the next seat
+	g.turn = (g.turn + 1) % len(g.players)
+
+	if g.gameType == UltimateGame {
+		g.updateUltimateState(player, placed, x, y)
+		return nil
 	}
 
-	//check win
-	win, _ := g.checkWin(player)
-	if win {
-		if player.Id == g.players[0].Id {
-			g.gameOverState = PlayerOneWin
-		} else {
-			g.gameOverState = PlayerTwoWin
+	//check win, only lines with the placed symbol could have been completed
+	if g.checkWin(placed) {
+		g.lineCompleted(player)
+	} else if g.moveCount == (len(g.board) * len(g.board)) { //check draw
+		g.setDraw()
+	}
+	return nil
+}
+
+// lineCompleted ends the game after player completed a line.
+// Player wins, in misère game the player loses and the other players share the win.
+func (g *TicTacToeGame) lineCompleted(player Player) {
+	seat := g.getSeat(player.Id)
+	g.winners = make([]int, 0, len(g.players))
+	for i := range g.players {
+		if (i == seat) != g.rules.Misere {
+			g.winners = append(g.winners, i)
 		}
-		g.gameState = GameOver
 	}
-	//check draw
-	if g.moveCount == (len(g.board) * len(g.board)) {
-		g.gameOverState = Draw
-		g.gameState = GameOver
+	g.gameOverState = Win
+	g.gameState = GameOver
+	g.endReason = EndReasonLine
+}
+
+// Abort ends the game without result, it returns an error if the game is not in play.
+func (g *TicTacToeGame) Abort() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gameState != WaitingForMove {
+		return errors.New("game not in play")
 	}
+	g.winners = nil
+	g.gameOverState = Aborted
+	g.gameState = GameOver
+	g.endReason = EndReasonAdmin
 	return nil
 }
 
+// EndWithout ends the game in play because losers are disconnected, the outcome (see timeout rule) is one of
+// TimeoutForfeit (the other players share the win), TimeoutAbort or TimeoutDraw.
+// It returns an error if the game is not in play.
+func (g *TicTacToeGame) EndWithout(losers []*Player, outcome string, reason string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gameState != WaitingForMove {
+		return errors.New("game not in play")
+	}
+	switch outcome {
+	case TimeoutAbort:
+		g.winners = nil
+		g.gameOverState = Aborted
+	case TimeoutDraw:
+		g.setDraw()
+	default:
+		g.winners = make([]int, 0, len(g.players))
+		for i, v := range g.players {
+			lost := false
+			for _, loser := range losers {
+				lost = lost || v.Id == loser.Id
+			}
+			if !lost {
+				g.winners = append(g.winners, i)
+			}
+		}
+		g.gameOverState = Win
+	}
+	g.gameState = GameOver
+	g.endReason = reason
+	return nil
+}
+
+// AddDisconnect counts disconnect of the player in the game in play and returns number of its disconnects.
+func (g *TicTacToeGame) AddDisconnect(player *Player) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	seat := g.getSeat(player.Id)
+	if g.gameState != WaitingForMove || seat == -1 {
+		return 0
+	}
+	g.disconnects[seat]++
+	return g.disconnects[seat]
+}
+
+// setDraw ends the game as a draw shared by all players.
+func (g *TicTacToeGame) setDraw() {
+	g.winners = make([]int, 0, len(g.players))
+	for i := range g.players {
+		g.winners = append(g.winners, i)
+	}
+	g.gameOverState = Draw
+	g.gameState = GameOver
+	g.endReason = EndReasonFull
+}
+
 // GetBoardInParsableFormat returns the board in a parsable format.
+// Ultimate games append the active sub-board and the macro board (see getUltimateBoardInParsableFormat).
 func (g *TicTacToeGame) GetBoardInParsableFormat() string {
 	g.mu.Lock()
 	defer g.mu.Unlock()
+	if g.gameType == UltimateGame {
+		return g.getUltimateBoardInParsableFormat()
+	}
+	return g.formatBoard(g.board)
+}
 
+// formatBoard converts board to parsable format, player IDs are replaced by seat numbers 1..N
+// (3 is a drawn sub-board in two player ultimate game).
+func (g *TicTacToeGame) formatBoard(board [][]int) string {
 	var result string
-	for _, row := range g.board {
+	for _, row := range board {
 		for i, col := range row {
-			if g.players[0].Id == col {
-				col = 1
-			} else if g.players[1].Id == col {
-				col = 2
-			} else {
-				col = 0
+			if col == drawnSubBoard {
+				col = len(g.players) + 1
+			} else if col != 0 {
+				col = g.getSeat(col) + 1
 			}
 			result += strconv.Itoa(col)
 			if i != len(row)-1 {
@@ -169,98 +340,102 @@ func (g *TicTacToeGame) GetBoardInParsableFormat() string {
 	return result
 }
 
-// check if player won the game on variable board size
-func (g *TicTacToeGame) checkWin(player Player) (bool, Player) {
-	// check col
-	for i := 0; i < len(g.board); i++ {
-		win := true
-		for j := 0; j < len(g.board); j++ {
-			if g.board[i][j] != player.Id {
-				win = false
-				break
-			}
-		}
-		if win {
-			return true, player
-		}
-	}
-
-	// check row
-	for i := 0; i < len(g.board); i++ {
-		win := true
-		for j := 0; j < len(g.board); j++ {
-			if g.board[j][i] != player.Id {
-				win = false
-				break
+// ParseBoard reads board in parsable format sent to clients, cells hold seat numbers 1..N or 0 if empty.
+func ParseBoard(board string) ([][]int, error) {
+	rows := strings.Split(board, rowSep)
+	result := make([][]int, len(rows))
+	for i, row := range rows {
+		cells := strings.Split(row, colSep)
+		result[i] = make([]int, len(cells))
+		for j, cell := range cells {
+			v, err := strconv.Atoi(cell)
+			if err != nil || v < 0 {
+				return nil, errors.New("invalid board cell " + cell)
 			}
-		}
-		if win {
-			return true, player
+			result[i][j] = v
 		}
 	}
+	return result, nil
+}
 
-	// check diagonal
-	win := true
-	for i := 0; i < len(g.board); i++ {
-		if g.board[i][i] != player.Id {
-			win = false
-			break
-		}
-	}
-	if win {
-		return true, player
-	}
+// check if line of symbol (ID of the player owning it) is completed on variable board size
+// result is interpreted by lineCompleted according to the rules of the game
+func (g *TicTacToeGame) checkWin(symbol int) bool {
+	return checkLines(g.board, symbol, g.winLength)
+}
 
-	// check anti-diagonal
-	win = true
-	for i := 0; i < len(g.board); i++ {
-		if g.board[i][len(g.board)-1-i] != player.Id {
-			win = false
-			break
+// checkLines returns true if length fields in a row, column or diagonal of the square board are filled with id.
+func checkLines(board [][]int, id int, length int) bool {
+	directions := [][2]int{{0, 1}, {1, 0}, {1, 1}, {1, -1}}
+	for i := 0; i < len(board); i++ {
+		for j := 0; j < len(board); j++ {
+			for _, d := range directions {
+				count := 0
+				x, y := i, j
+				for count < length && x >= 0 && x < len(board) && y >= 0 && y < len(board) && board[x][y] == id {
+					count++
+					x += d[0]
+					y += d[1]
+				}
+				if count == length {
+					return true
+				}
+			}
 		}
 	}
-	if win {
-		return true, player
-	}
-
-	return false, Player{}
+	return false
 }
 
-// new tictactoe game
-func NewTickTackToeGame(boardSize int) *TicTacToeGame {
+// new tictactoe game with given number of seats, winLength symbols in a row are needed to win
+func NewTickTackToeGame(boardSize int, seats int, winLength int) *TicTacToeGame {
 	board := make([][]int, boardSize)
 	for i := 0; i < boardSize; i++ {
 		board[i] = make([]int, boardSize)
 	}
-	players := [2]*Player{}
-	players[0] = &Player{}
-	players[1] = &Player{}
+	players := make([]*Player, seats)
+	for i := range players {
+		players[i] = &Player{}
+	}
 	return &TicTacToeGame{
-		board:          board,
-		players:        players,
-		gameState:      WaitingForPlayersReady,
-		gameOverState:  NotOver,
-		readyPlayerOne: 0,
-		readyPlayerTwo: 0,
-		moveCount:      0,
+		board:         board,
+		players:       players,
+		gameState:     WaitingForPlayersReady,
+		gameOverState: NotOver,
+		ready:         make([]bool, seats),
+		disconnects:   make([]int, seats),
+		winLength:     winLength,
+		moveCount:     0,
+		gameType:      ClassicGame,
 	}
 }
 
-// IsFull returns true if both players are in the game.
+// IsFull returns true if all seats are taken.
 func (g *TicTacToeGame) IsFull() bool {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	return g.players[0].Id != 0 && g.players[1].Id != 0
+	for _, v := range g.players {
+		if v.Id == 0 {
+			return false
+		}
+	}
+	return true
 }
 
-// IsReady returns true if both players are ready.
+// IsReady returns true if all players are ready.
 func (g *TicTacToeGame) IsReady() bool {
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	return g.readyPlayerOne != 0 && g.readyPlayerTwo != 0
+	for _, v := range g.ready {
+		if !v {
+			return false
+		}
+	}
+	return true
 }
 
 // Start starts the game.
+// The first game is started by the first seat, every replay by the second seat (the second player started replays
+// of two player games).
 func (g *TicTacToeGame) Start() error {
 	if !g.IsFull() {
 		return errors.New("game not full")
@@ -271,7 +446,9 @@ func (g *TicTacToeGame) Start() error {
 	g.Reset(true)
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	g.gameState = WaitingForPlayerOneMove
+	g.gameState = WaitingForMove
+	g.turn = g.startingSeat
+	g.startingSeat = 1 % len(g.players)
 	return nil
 }
 
@@ -284,11 +461,67 @@ func (g *TicTacToeGame) Reset(keepPlayers bool) {
 		g.board[i] = make([]int, len(g.board))
 	}
 	if !keepPlayers {
-		g.players = [2]*Player{}
+		for i := range g.players {
+			g.players[i] = &Player{}
+		}
+		g.startingSeat = 0
 	}
 	g.gameState = WaitingForPlayersReady
 	g.gameOverState = NotOver
-	g.readyPlayerOne = 0
-	g.readyPlayerTwo = 0
+	g.ready = make([]bool, len(g.players))
+	g.disconnects = make([]int, len(g.players))
+	g.endReason = ""
+	g.winners = nil
 	g.moveCount = 0
+	if g.gameType == UltimateGame {
+		g.resetUltimate()
+	}
+}
+
+// GetId returns unique id of the game.
+func (g *TicTacToeGame) GetId() int {
+	return g.id
+}
+
+// GetBoardSize returns number of rows (and columns) of the board, 9 in ultimate game.
+func (g *TicTacToeGame) GetBoardSize() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.board)
+}
+
+// GetState returns state of the game (see const.go).
+func (g *TicTacToeGame) GetState() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.gameState
+}
+
+// GetGameOverState returns game over state of the game (see const.go).
+func (g *TicTacToeGame) GetGameOverState() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.gameOverState
+}
+
+// GetEndReason returns reason of the game end (see const.go), empty if the game is not over.
+func (g *TicTacToeGame) GetEndReason() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.endReason
+}
+
+// GetRules returns rule options of the game.
+func (g *TicTacToeGame) GetRules() Rules {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rules
+}
+
+// GetGameTypeName returns the name of the game type as used in the join operation.
+func (g *TicTacToeGame) GetGameTypeName() string {
+	if g.gameType == UltimateGame {
+		return GameTypeUltimate
+	}
+	return GameTypeClassic
 }
@@ -0,0 +1,50 @@
+package util
+
+import "testing"
+
+func TestReplayStartingSeat(t *testing.T) {
+	game := NewTickTackToeGame(4, 3, 3)
+	for i := 1; i <= 3; i++ {
+		if err := game.Join(&Player{Id: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//first game is started by the first seat, every replay by the second seat
+	for i, expected := range []int{1, 2, 2} {
+		if err := game.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if onTurn := game.GetPlayerOnTurn(); onTurn.Id != expected {
+			t.Errorf("game %d started by player %d, expected %d", i+1, onTurn.Id, expected)
+		}
+		if err := game.Abort(); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range game.GetPlayers() {
+			if err := game.PlayAgain(*v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestParseBoard(t *testing.T) {
+	game := NewTickTackToeGame(3, 2, 3)
+	for i := 1; i <= 2; i++ {
+		if err := game.Join(&Player{Id: 10 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	game.board[0][2] = 11
+	game.board[2][1] = 12
+	board, err := ParseBoard(game.formatBoard(game.board))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(board) != 3 || len(board[0]) != 3 || board[0][2] != 1 || board[2][1] != 2 || board[1][1] != 0 {
+		t.Errorf("parsed board %v, expected seats of formatted board", board)
+	}
+	if _, err := ParseBoard("0|x|0"); err == nil {
+		t.Error("board with invalid cell parsed")
+	}
+}
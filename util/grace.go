@@ -0,0 +1,96 @@
+package util
+
+import (
+	"fmt"
+	"time"
+)
+
+// Reconnect grace policy of a game is set by its rules (see rules.go): grace period for a disconnected player,
+// disconnects allowed per player, outcome of the game ended because of disconnected player and claiming the win.
+
+// getGraceDeadline returns time the game of the disconnected player ends because of grace rule,
+// zero time if the rule does not apply. Caller must hold stateMutex.
+func getGraceDeadline(player *Player) time.Time {
+	if player.Connected {
+		return time.Time{}
+	}
+	game := findGame(player)
+	if game == nil || game.GetRules().Grace == 0 || game.GetState() != WaitingForMove {
+		return time.Time{}
+	}
+	return player.disconnectedAt.Add(time.Second * time.Duration(game.GetRules().Grace))
+}
+
+// endGameWithout ends the game in play because losers are disconnected and sends game over to the other players.
+// Outcome follows timeout rule of the game, claimed win is always a forfeit.
+// It returns false if the game is not in play. Caller must hold stateMutex.
+func endGameWithout(game *TicTacToeGame, losers []*Player, reason string) bool {
+	outcome := game.GetRules().OnTimeout
+	if reason == EndReasonClaim {
+		outcome = TimeoutForfeit
+	}
+	if err := game.EndWithout(losers, outcome, reason); err != nil {
+		return false
+	}
+	recordGameEnd(game)
+	msg := createOpCode(MsgGameOverOpcode, true, game.GetGameResult()+"("+getEndReasonText(reason)+")")
+	for _, v := range game.GetPlayers() {
+		if v.Id == 0 || isPlayerIn(v, losers) {
+			continue
+		}
+		_, err := sendMsg(v.Conn, msg, 0)
+		if err != nil {
+			playerLog(v).Warn("could not send game over to player", F(logKeyError, err))
+		}
+	}
+	return true
+}
+
+// handleClaimOpcode ends the game in play as a win of the player and the other connected players
+// if claim rule allows it and an opponent is disconnected. Caller must hold stateMutex.
+func handleClaimOpcode(player *Player, game *TicTacToeGame) (string, error) {
+	if game == nil || player.Status != InGame {
+		return "", fmt.Errorf("player not in game" + ArgSep + SrvErrInvalidOp)
+	}
+	if !game.GetRules().Claim {
+		return "", fmt.Errorf("rules do not allow claiming the win" + ArgSep + SrvErrInvalidOp)
+	}
+	losers := make([]*Player, 0)
+	for _, v := range game.GetOtherPlayers(player) {
+		if !v.Connected {
+			losers = append(losers, v)
+		}
+	}
+	if len(losers) == 0 {
+		return "", fmt.Errorf("no opponent is disconnected" + ArgSep + SrvErrInvalidOp)
+	}
+	if !endGameWithout(game, losers, EndReasonClaim) {
+		return "", fmt.Errorf("game not in play" + ArgSep + SrvErrInvalidOp)
+	}
+	playerLog(player).Info("player claimed the win")
+	return "", nil
+}
+
+// getEndReasonText returns explanation of game end appended to the result in game over message.
+func getEndReasonText(reason string) string {
+	switch reason {
+	case EndReasonGrace:
+		return "Opponent did not reconnect"
+	case EndReasonDrops:
+		return "Opponent disconnected too many times"
+	case EndReasonClaim:
+		return "Win claimed"
+	default:
+		return "Opponent disconnected"
+	}
+}
+
+// isPlayerIn returns true if player with the same ID is in the list.
+func isPlayerIn(player *Player, list []*Player) bool {
+	for _, v := range list {
+		if v.Id == player.Id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package util
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test harness of the server: scripted clients speaking KIVUPS to the server in the same process over
+// in-memory transport, and a fake clock that tests advance, so ping timeouts are tested without waiting.
+// Frames are still awaited in real time, the server answers them from its own goroutines.
+
+// testClient is a client of in-process server, received frames are delivered to frames.
+type testClient struct {
+	t      *testing.T
+	conn   Transport
+	frames chan Frame
+}
+
+var testClientId int64
+
+// connectTestClient connects new client to in-process server the same way as main.
+func connectTestClient(t *testing.T) *testClient {
+	server, client := NewPipeTransport()
+	if err := AdmitConnection(server); err != nil {
+		t.Fatal(err)
+	}
+	id := int(atomic.AddInt64(&testClientId, 1))
+	go ProcessClient(server, &Player{Conn: server, ClientId: id, TimeSinceLastPing: Now()})
+	c := &testClient{t: t, conn: client, frames: make(chan Frame, 64)}
+	go func() {
+		defer close(c.frames)
+		for {
+			frame, err := client.ReadFrame()
+			if err != nil {
+				return
+			}
+			c.frames <- frame
+		}
+	}()
+	return c
+}
+
+func (c *testClient) send(opcode string, args ...string) {
+	if err := c.conn.WriteFrame(Frame{Opcode: opcode, Data: []byte(strings.Join(args, ArgSep))}); err != nil {
+		c.t.Errorf("could not send %s: %v", opcode, err)
+	}
+}
+
+// expect returns next frame with the given opcode, other frames are skipped.
+func (c *testClient) expect(opcode string) Frame {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				c.t.Errorf("connection closed while waiting for %s", opcode)
+				return Frame{}
+			}
+			if frame.Opcode == opcode {
+				return frame
+			}
+		case <-timeout:
+			c.t.Errorf("timeout while waiting for %s", opcode)
+			return Frame{}
+		}
+	}
+}
+
+// expectData returns data of the next frame with the given opcode and reports error unless it starts with prefix.
+func (c *testClient) expectData(opcode string, prefix string) string {
+	c.t.Helper()
+	data := string(c.expect(opcode).Data)
+	if !strings.HasPrefix(data, prefix) {
+		c.t.Errorf("%s returned %q, expected %q", opcode, data, prefix)
+	}
+	return data
+}
+
+// expectClosed waits until the server closes the connection, remaining frames are skipped.
+func (c *testClient) expectClosed() {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.frames:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.t.Errorf("timeout while waiting for the connection to close")
+			return
+		}
+	}
+}
+
+// login logs in player with the given name and returns the response.
+func (c *testClient) login(name string) string {
+	c.send(MsgLoginOpcode, name)
+	return string(c.expect(MsgLoginOpcode).Data)
+}
+
+// ping sends ping and waits for its response, so the server has recorded it.
+func (c *testClient) ping() {
+	c.send(MsgPingOpcode)
+	c.expectData(MsgPingOpcode, ClientMsgOk)
+}
+
+// move sends move and waits for the board broadcast to the player.
+func (c *testClient) move(x, y string) {
+	c.send(MsgMoveOpcode, x, y)
+	c.expectData(MsgMoveOpcode, ClientMsgOk)
+}
+
+// startTestGame logs in two clients and joins them to a game of the given type and rules,
+// first starts the game and has the first turn.
+func startTestGame(t *testing.T, names [2]string, join ...string) (first *testClient, second *testClient) {
+	first, second = connectTestClient(t), connectTestClient(t)
+	first.login(names[0])
+	second.login(names[1])
+	first.send(MsgJoinOpcode, join...)
+	first.expectData(MsgJoinOpcode, ClientMsgOk)
+	second.send(MsgJoinOpcode, join...)
+	first.expectData(MsgGameStartedOpcode, ClientMsgOk+ArgSep+names[1])
+	second.expectData(MsgGameStartedOpcode, ClientMsgOk+ArgSep+names[0])
+	first.expect(MsgYourTurnOpcode)
+	return first, second
+}
+
+// useFakeClock makes the server use a fake clock until the test finishes.
+func useFakeClock(t *testing.T) *FakeClock {
+	clock := NewFakeClock(time.Now())
+	SetClock(clock)
+	t.Cleanup(func() { SetClock(NewRealClock()) })
+	return clock
+}
+
+// advanceClock moves the clock by d. It first waits until the liveness manager waits on a timer of the clock,
+// so the manager does not miss time it was not waiting for yet.
+func advanceClock(t *testing.T, clock *FakeClock, d time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Timers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("liveness manager is not waiting on the fake clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(d)
+}
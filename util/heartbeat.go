@@ -0,0 +1,62 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server heartbeat is sent to clients that announced heartbeat capability in hello (see liveness.go for scheduling).
+// The echo counts as a ping, so a client with healthy connection stays connected even if its own pings stop,
+// and it measures round-trip time announced to the other players of the game.
+
+// sendHeartbeat sends next heartbeat to the player. Caller must hold stateMutex.
+func sendHeartbeat(player *Player) {
+	player.heartbeatSeq++
+	player.heartbeatSent = Now()
+	msg := fmt.Sprint(player.heartbeatSeq) + ArgSep + getOpponentRtts(player)
+	_, err := sendMsg(player.Conn, createOpCode(MsgHeartbeatOpcode, true, msg), 0)
+	if err != nil {
+		playerLog(player).Warn("could not send heartbeat to player", F(logKeyError, err))
+	}
+}
+
+// handleHeartbeatEcho handles echo of the heartbeat, echo of an older heartbeat counts as a ping without measuring round-trip time.
+// Caller must hold stateMutex.
+func handleHeartbeatEcho(player *Player, data []string) error {
+	if len(data) != 1 {
+		return fmt.Errorf("wrong number of arguments" + ArgSep + SrvErrInvalidOp)
+	}
+	seq, err := strconv.Atoi(data[0])
+	if err != nil || seq < 1 || seq > player.heartbeatSeq {
+		return fmt.Errorf("unknown heartbeat" + ArgSep + SrvErrInvalidOp)
+	}
+	if seq == player.heartbeatSeq {
+		player.Rtt = Now().Sub(player.heartbeatSent)
+	}
+	player.TimeSinceLastPing = Now()
+	liveness.ping(player)
+	return nil
+}
+
+// getNextHeartbeat returns time the next heartbeat should be sent to the player. Caller must hold stateMutex.
+func getNextHeartbeat(player *Player) time.Time {
+	return player.heartbeatSent.Add(getPingTime())
+}
+
+// getOpponentRtts returns round-trip times of the other players in the game of the player as name=milliseconds
+// separated by ruleSep, players without measured round-trip time are left out. Caller must hold stateMutex.
+func getOpponentRtts(player *Player) string {
+	game := findGame(player)
+	if game == nil {
+		return ""
+	}
+	rtts := make([]string, 0)
+	for _, v := range game.GetOtherPlayers(player) {
+		if v.Rtt > 0 {
+			rtts = append(rtts, v.Name+"="+fmt.Sprint(v.Rtt.Milliseconds()))
+		}
+	}
+	return strings.Join(rtts, ruleSep)
+}
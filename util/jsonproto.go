@@ -0,0 +1,444 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON wire format. A JSON message is MsgMagicJSON, 4 digit body length and JSON body with named fields
+// of the operation instead of ";" separated arguments:
+//
+//	client: {"op":"003","x":1,"y":2}
+//	server: {"op":"003","status":"ok","board":[[1,0,0],[0,2,0],[0,0,0]]}
+//	server: {"op":"012","status":"ok","state":"ingame","turn":"you","board":[[1,0,0],[0,2,0],[0,0,0]],"opponents":["bob"]}
+//	server: {"op":"002","status":"err","error":"player not in lobby","reason":"criticalerror"}
+//
+// Fields are converted from and to the same frames as KIVUPS messages, so both formats map onto the same
+// operations. Server messages the fields cannot describe exactly carry the KIVUPS arguments in args,
+// clients may send args instead of the fields too.
+
+// JSON messages are longer than text ones because of the field names and quoting
+const maxJSONBodyLen = 4 * MaxDataLen
+
+// values of state, turn and result fields
+const (
+	jsonTurnYou       = "you"
+	jsonTurnOther     = "other"
+	jsonResultWin     = "win"
+	jsonResultDraw    = "draw"
+	jsonResultAborted = "aborted"
+	gameResultDraw    = "Draw"
+	gameResultAborted = "Aborted"
+)
+
+var errJSONArg = &frameError{msg: "argument contains " + ArgSep}
+
+// recovery options sent in state field, in game options also set turn or result
+var jsonRecoveryStates = map[string]string{
+	ClientMsgRecovery_InLobby:               "inlobby",
+	ClientMsgRecovery_ReadyForGame:          "readyforgame",
+	ClientMsgRecovery_InGame_YourTurn:       "ingame",
+	ClientMsgRecovery_InGame_OtherTurn:      "ingame",
+	ClientMsgRecovery_InGame_GameOver:       "gameover",
+	ClientMsgRecovery_InGame_GameGone:       "gamegone",
+	ClientMsgRecovery_InGame_OtherPlayAgain: "otherplayagain",
+}
+
+// error reasons sent in reason field of err messages
+var jsonErrReasons = map[string]bool{
+	SrvErrInvalidOp: true, SrvErrRateLimited: true, SrvErrTooManyConns: true, SrvErrServerBusy: true,
+	SrvErrLoginTimeout: true, SrvErrIncompatibleVersion: true, SrvErrInvalidFrame: true,
+	ClientMsgGameGone: true,
+}
+
+// jsonMessage is a body of JSON message.
+type jsonMessage struct {
+	Op     string `json:"op"`
+	Status string `json:"status,omitempty"` //ok or err, only in server messages
+
+	Name         string   `json:"name,omitempty"`         //login
+	Version      int      `json:"version,omitempty"`      //hello
+	Capabilities []string `json:"capabilities,omitempty"` //hello
+	GameType     string   `json:"gameType,omitempty"`     //join, game started
+	Rules        []string `json:"rules,omitempty"`        //join, game started
+	X            *int     `json:"x,omitempty"`            //move
+	Y            *int     `json:"y,omitempty"`            //move
+	Symbol       int      `json:"symbol,omitempty"`       //move
+	Seq          int      `json:"seq,omitempty"`          //heartbeat
+
+	Message        string    `json:"message,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Reason         string    `json:"reason,omitempty"`    //reason code of error or reason the game ended
+	BoardSize      int       `json:"boardSize,omitempty"` //login, recovery login
+	Board          [][]int   `json:"board,omitempty"`     //seat numbers 1..N, 0 if empty
+	ActiveSubBoard *int      `json:"activeSubBoard,omitempty"`
+	MacroBoard     [][]int   `json:"macroBoard,omitempty"`
+	State          string    `json:"state,omitempty"` //recovery
+	Turn           string    `json:"turn,omitempty"`  //recovery in game, you or other
+	Result         string    `json:"result,omitempty"`
+	Winners        []string  `json:"winners,omitempty"`
+	Opponents      []string  `json:"opponents,omitempty"`
+	Rtts           []jsonRtt `json:"rtts,omitempty"` //heartbeat
+
+	Args []string `json:"args,omitempty"` //KIVUPS arguments used instead of the fields
+}
+
+// jsonRtt is round-trip time of the opponent announced in heartbeat.
+type jsonRtt struct {
+	Name string `json:"name"`
+	Ms   int64  `json:"ms"`
+}
+
+// parseJSONHeader returns body length from the header of a JSON message.
+func parseJSONHeader(header []byte) (int, error) {
+	if len(header) != len(MsgMagicJSON)+MaxMsgDataLen || string(header[:len(MsgMagicJSON)]) != MsgMagicJSON {
+		return 0, errFrameMagic
+	}
+	bodyLen, ok := parseDigits(header[len(MsgMagicJSON):])
+	if !ok {
+		return 0, errFrameLength
+	}
+	return bodyLen, nil
+}
+
+// decodeJSONFrame converts body of JSON message to frame.
+func decodeJSONFrame(body []byte) (Frame, error) {
+	var msg jsonMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return Frame{}, &frameError{msg: "invalid json message: " + err.Error()}
+	}
+	if len(msg.Op) != len(MsgLoginOpcode) {
+		return Frame{Opcode: msg.Op}, &frameError{msg: fmt.Sprintf("invalid json message: bad opcode %q", msg.Op)}
+	}
+	switch msg.Status {
+	case "":
+		for _, arg := range msg.requestStrings() {
+			if strings.Contains(arg, ArgSep) {
+				return Frame{Opcode: msg.Op}, errJSONArg
+			}
+		}
+	case ClientMsgOk, ClientMsgErr:
+	default:
+		return Frame{Opcode: msg.Op}, &frameError{msg: fmt.Sprintf("invalid json message: bad status %q", msg.Status)}
+	}
+	return Frame{Opcode: msg.Op, Data: []byte(msg.data())}, nil
+}
+
+// encodeJSONFrame returns frame as JSON message, leading ok or err argument of server frames becomes status.
+func encodeJSONFrame(frame Frame) []byte {
+	data := string(frame.Data)
+	msg := jsonMessage{Op: frame.Opcode}
+	payload := data
+	if args := strings.SplitN(data, ArgSep, 2); len(args) == 2 && (args[0] == ClientMsgOk || args[0] == ClientMsgErr) {
+		msg.Status, payload = args[0], args[1]
+	}
+	switch msg.Status {
+	case ClientMsgOk:
+		msg.setResult(payload)
+	case ClientMsgErr:
+		msg.setError(payload)
+	default:
+		msg.setRequest(payload)
+	}
+	if msg.data() != data {
+		msg = jsonMessage{Op: frame.Opcode, Status: msg.Status, Args: strings.Split(payload, ArgSep)}
+	}
+	body, _ := json.Marshal(msg)
+	return []byte(MsgMagicJSON + fmt.Sprintf("%04d", len(body)) + string(body))
+}
+
+// requestStrings returns fields of client message which become KIVUPS arguments.
+func (m *jsonMessage) requestStrings() []string {
+	result := append([]string{m.Name, m.GameType}, m.Rules...)
+	result = append(result, m.Capabilities...)
+	return append(result, m.Args...)
+}
+
+// data returns KIVUPS data of the message.
+func (m *jsonMessage) data() string {
+	var payload string
+	switch {
+	case m.Args != nil:
+		payload = strings.Join(m.Args, ArgSep)
+	case m.Status == ClientMsgOk:
+		payload = m.resultData()
+	case m.Status == ClientMsgErr:
+		payload = m.errorData()
+	default:
+		payload = m.requestData()
+	}
+	if m.Status == "" {
+		return payload
+	}
+	return m.Status + ArgSep + payload
+}
+
+// setRequest sets fields from arguments of client message.
+func (m *jsonMessage) setRequest(payload string) {
+	args := strings.Split(payload, ArgSep)
+	switch m.Op {
+	case MsgLoginOpcode:
+		m.Name = payload
+	case MsgHelloOpcode:
+		m.Version, _ = strconv.Atoi(args[0])
+		if len(args) > 1 && args[1] != "" {
+			m.Capabilities = strings.Split(args[1], capSep)
+		}
+	case MsgJoinOpcode:
+		if payload != "" {
+			m.GameType, m.Rules = args[0], args[1:]
+		}
+	case MsgMoveOpcode:
+		if len(args) >= 2 {
+			m.X, m.Y = parseJSONInt(args[0]), parseJSONInt(args[1])
+		}
+		if len(args) == 3 {
+			m.Symbol, _ = strconv.Atoi(args[2])
+		}
+	case MsgHeartbeatOpcode:
+		m.Seq, _ = strconv.Atoi(payload)
+	}
+}
+
+// requestData returns arguments of client message from fields.
+func (m *jsonMessage) requestData() string {
+	switch m.Op {
+	case MsgLoginOpcode:
+		return m.Name
+	case MsgHelloOpcode:
+		if m.Version == 0 {
+			return ""
+		}
+		if m.Capabilities == nil {
+			return strconv.Itoa(m.Version)
+		}
+		return strconv.Itoa(m.Version) + ArgSep + strings.Join(m.Capabilities, capSep)
+	case MsgJoinOpcode:
+		if m.GameType == "" && len(m.Rules) == 0 {
+			return ""
+		}
+		return strings.Join(append([]string{m.GameType}, m.Rules...), ArgSep)
+	case MsgMoveOpcode:
+		if m.X == nil || m.Y == nil {
+			return ""
+		}
+		data := strconv.Itoa(*m.X) + ArgSep + strconv.Itoa(*m.Y)
+		if m.Symbol != 0 {
+			data += ArgSep + strconv.Itoa(m.Symbol)
+		}
+		return data
+	case MsgHeartbeatOpcode:
+		if m.Seq == 0 {
+			return ""
+		}
+		return strconv.Itoa(m.Seq)
+	}
+	return ""
+}
+
+// setResult sets fields from arguments of server ok message.
+func (m *jsonMessage) setResult(payload string) {
+	args := strings.Split(payload, ArgSep)
+	switch m.Op {
+	case MsgLoginOpcode:
+		if i := strings.LastIndex(payload, ArgSep); i >= 0 {
+			m.Message = payload[:i]
+			m.BoardSize, _ = strconv.Atoi(payload[i+1:])
+		}
+	case MsgMoveOpcode:
+		m.setBoard(payload)
+	case MsgGameStartedOpcode:
+		m.Opponents = splitJSONList(args[0])
+		if len(args) == 3 {
+			m.GameType, m.Rules = args[1], splitJSONList(args[2])
+		}
+	case MsgGameOverOpcode:
+		m.setGameResult(payload)
+	case MsgRecoveryOpcode:
+		m.State = jsonRecoveryStates[args[0]]
+		switch {
+		case len(args) == 3 && (args[0] == ClientMsgRecovery_InGame_YourTurn || args[0] == ClientMsgRecovery_InGame_OtherTurn):
+			m.Turn = jsonTurnOther
+			if args[0] == ClientMsgRecovery_InGame_YourTurn {
+				m.Turn = jsonTurnYou
+			}
+			m.setBoard(args[1])
+			m.Opponents = splitJSONList(args[2])
+		case len(args) == 4 && args[0] == ClientMsgRecovery_InGame_GameOver:
+			m.setBoard(args[1])
+			m.setGameResult(args[2])
+			m.Opponents = splitJSONList(args[3])
+		}
+	case MsgHelloOpcode:
+		if len(args) == 2 {
+			m.Version, _ = strconv.Atoi(args[0])
+			m.Capabilities = splitJSONList(args[1])
+		}
+	case MsgHeartbeatOpcode:
+		if len(args) == 2 {
+			m.Seq, _ = strconv.Atoi(args[0])
+			for _, v := range splitJSONList(args[1]) {
+				parts := strings.SplitN(v, "=", 2)
+				if len(parts) != 2 {
+					return
+				}
+				ms, _ := strconv.ParseInt(parts[1], 10, 64)
+				m.Rtts = append(m.Rtts, jsonRtt{Name: parts[0], Ms: ms})
+			}
+		}
+	default:
+		m.Message = payload
+	}
+}
+
+// resultData returns arguments of server ok message from fields.
+func (m *jsonMessage) resultData() string {
+	switch m.Op {
+	case MsgLoginOpcode:
+		return m.Message + ArgSep + strconv.Itoa(m.BoardSize)
+	case MsgMoveOpcode:
+		return m.boardData()
+	case MsgGameStartedOpcode:
+		data := strings.Join(m.Opponents, ruleSep)
+		if m.GameType != "" {
+			data += ArgSep + m.GameType + ArgSep + strings.Join(m.Rules, ruleSep)
+		}
+		return data
+	case MsgGameOverOpcode:
+		return m.gameResultData()
+	case MsgRecoveryOpcode:
+		for option, state := range jsonRecoveryStates {
+			if state != m.State {
+				continue
+			}
+			switch {
+			case option == ClientMsgRecovery_InGame_YourTurn && m.Turn == jsonTurnYou,
+				option == ClientMsgRecovery_InGame_OtherTurn && m.Turn == jsonTurnOther:
+				return option + ArgSep + m.boardData() + ArgSep + strings.Join(m.Opponents, ruleSep)
+			case option == ClientMsgRecovery_InGame_GameOver:
+				return option + ArgSep + m.boardData() + ArgSep + m.gameResultData() + ArgSep + strings.Join(m.Opponents, ruleSep)
+			case state != "ingame":
+				return option
+			}
+		}
+		return ""
+	case MsgHelloOpcode:
+		return strconv.Itoa(m.Version) + ArgSep + strings.Join(m.Capabilities, capSep)
+	case MsgHeartbeatOpcode:
+		rtts := make([]string, 0, len(m.Rtts))
+		for _, v := range m.Rtts {
+			rtts = append(rtts, v.Name+"="+strconv.FormatInt(v.Ms, 10))
+		}
+		return strconv.Itoa(m.Seq) + ArgSep + strings.Join(rtts, ruleSep)
+	}
+	return m.Message
+}
+
+// setError sets fields from arguments of server err message, trailing reason code goes to reason.
+func (m *jsonMessage) setError(payload string) {
+	if m.Op == MsgLoginOpcode && strings.HasPrefix(payload, ClientMsgRecoveryLogin+ArgSep) {
+		m.Error = ClientMsgRecoveryLogin
+		m.BoardSize, _ = strconv.Atoi(strings.TrimPrefix(payload, ClientMsgRecoveryLogin+ArgSep))
+		return
+	}
+	m.Error = payload
+	if i := strings.LastIndex(payload, ArgSep); i >= 0 && jsonErrReasons[payload[i+1:]] {
+		m.Error, m.Reason = payload[:i], payload[i+1:]
+	}
+}
+
+// errorData returns arguments of server err message from fields.
+func (m *jsonMessage) errorData() string {
+	data := m.Error
+	if m.BoardSize != 0 {
+		data += ArgSep + strconv.Itoa(m.BoardSize)
+	}
+	if m.Reason != "" {
+		data += ArgSep + m.Reason
+	}
+	return data
+}
+
+// setBoard sets board fields from board in parsable format, ultimate board also has active sub-board and macro board.
+func (m *jsonMessage) setBoard(board string) {
+	parts := strings.Split(board, boardPartSep)
+	m.Board, _ = ParseBoard(parts[0])
+	if len(parts) == 3 {
+		m.ActiveSubBoard = parseJSONInt(parts[1])
+		m.MacroBoard, _ = ParseBoard(parts[2])
+	}
+}
+
+// boardData returns board fields in parsable format.
+func (m *jsonMessage) boardData() string {
+	data := formatJSONBoard(m.Board)
+	if m.MacroBoard != nil && m.ActiveSubBoard != nil {
+		data += boardPartSep + strconv.Itoa(*m.ActiveSubBoard) + boardPartSep + formatJSONBoard(m.MacroBoard)
+	}
+	return data
+}
+
+// setGameResult sets result, winners and reason fields from game result with optional reason in parentheses.
+func (m *jsonMessage) setGameResult(result string) {
+	if i := strings.LastIndex(result, "("); i >= 0 && strings.HasSuffix(result, ")") {
+		result, m.Reason = result[:i], result[i+1:len(result)-1]
+	}
+	switch result {
+	case gameResultDraw:
+		m.Result = jsonResultDraw
+	case gameResultAborted:
+		m.Result = jsonResultAborted
+	default:
+		m.Result = jsonResultWin
+		m.Winners = splitJSONList(result)
+	}
+}
+
+// gameResultData returns game result from result, winners and reason fields.
+func (m *jsonMessage) gameResultData() string {
+	var data string
+	switch m.Result {
+	case jsonResultDraw:
+		data = gameResultDraw
+	case jsonResultAborted:
+		data = gameResultAborted
+	default:
+		data = strings.Join(m.Winners, ruleSep)
+	}
+	if m.Reason != "" {
+		data += "(" + m.Reason + ")"
+	}
+	return data
+}
+
+// formatJSONBoard returns board of seat numbers in parsable format.
+func formatJSONBoard(board [][]int) string {
+	rows := make([]string, 0, len(board))
+	for _, row := range board {
+		cells := make([]string, 0, len(row))
+		for _, cell := range row {
+			cells = append(cells, strconv.Itoa(cell))
+		}
+		rows = append(rows, strings.Join(cells, colSep))
+	}
+	return strings.Join(rows, rowSep)
+}
+
+// parseJSONInt returns number or nil if the argument is not a number.
+func parseJSONInt(arg string) *int {
+	v, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// splitJSONList splits comma separated list, empty list is nil.
+func splitJSONList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ruleSep)
+}
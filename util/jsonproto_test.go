@@ -0,0 +1,100 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		opcode string
+		data   string
+		body   string
+	}{
+		//client messages
+		{MsgLoginOpcode, "alice", `{"op":"001","name":"alice"}`},
+		{MsgJoinOpcode, "", `{"op":"002"}`},
+		{MsgJoinOpcode, "classic;size=4;misere", `{"op":"002","gameType":"classic","rules":["size=4","misere"]}`},
+		{MsgMoveOpcode, "0;2", `{"op":"003","x":0,"y":2}`},
+		{MsgMoveOpcode, "1;1;2", `{"op":"003","x":1,"y":1,"symbol":2}`},
+		{MsgPlayAgainOpcode, "", `{"op":"004"}`},
+		{MsgReturnToStartOpcode, "", `{"op":"006"}`},
+		{MsgPingOpcode, "", `{"op":"011"}`},
+		{MsgRecoveryOpcode, "", `{"op":"012"}`},
+		{MsgHelloOpcode, "2;heartbeat,rules", `{"op":"016","version":2,"capabilities":["heartbeat","rules"]}`},
+		{MsgHeartbeatOpcode, "3", `{"op":"017","seq":3}`},
+		{MsgClaimOpcode, "", `{"op":"018"}`},
+
+		//server messages
+		{MsgLoginOpcode, "ok;Welcome alice. Your ID is: 1;3", `{"op":"001","status":"ok","message":"Welcome alice. Your ID is: 1","boardSize":3}`},
+		{MsgLoginOpcode, "err;recovery_login;4", `{"op":"001","status":"err","error":"recovery_login","boardSize":4}`},
+		{MsgJoinOpcode, "ok;joined game 7", `{"op":"002","status":"ok","message":"joined game 7"}`},
+		{MsgJoinOpcode, "err;player not in lobby;criticalerror", `{"op":"002","status":"err","error":"player not in lobby","reason":"criticalerror"}`},
+		{MsgMoveOpcode, "ok;1|0|0--0|2|0--0|0|0", `{"op":"003","status":"ok","board":[[1,0,0],[0,2,0],[0,0,0]]}`},
+		{MsgMoveOpcode, "ok;1|0--0|0@-1@0|0--0|0", `{"op":"003","status":"ok","board":[[1,0],[0,0]],"activeSubBoard":-1,"macroBoard":[[0,0],[0,0]]}`},
+		{MsgPlayAgainOpcode, "err;gamegone", `{"op":"004","status":"err","error":"gamegone"}`},
+		{MsgGameStartedOpcode, "ok;bob", `{"op":"005","status":"ok","opponents":["bob"]}`},
+		{MsgGameStartedOpcode, "ok;bob,carol;classic;size=4", `{"op":"005","status":"ok","gameType":"classic","rules":["size=4"],"opponents":["bob","carol"]}`},
+		{MsgReturnToStartOpcode, "ok;left the lobby", `{"op":"006","status":"ok","message":"left the lobby"}`},
+		{MsgGameOverOpcode, "ok;alice", `{"op":"007","status":"ok","result":"win","winners":["alice"]}`},
+		{MsgGameOverOpcode, "ok;Draw", `{"op":"007","status":"ok","result":"draw"}`},
+		{MsgGameOverOpcode, "ok;Aborted(ended by admin)", `{"op":"007","status":"ok","reason":"ended by admin","result":"aborted"}`},
+		{MsgErrOpcode, "err;invalid frame;invalidframe", `{"op":"009","status":"err","error":"invalid frame","reason":"invalidframe"}`},
+		{MsgYourTurnOpcode, "ok;", `{"op":"010","status":"ok"}`},
+		{MsgPingOpcode, "ok;ping", `{"op":"011","status":"ok","message":"ping"}`},
+		{MsgRecoveryOpcode, "ok;recovery_inlobby", `{"op":"012","status":"ok","state":"inlobby"}`},
+		{MsgRecoveryOpcode, "ok;recovery_ingame_yourturn;1|0--0|0;bob", `{"op":"012","status":"ok","board":[[1,0],[0,0]],"state":"ingame","turn":"you","opponents":["bob"]}`},
+		{MsgRecoveryOpcode, "ok;recovery_ingame_otherturn;1|0--0|0;bob", `{"op":"012","status":"ok","board":[[1,0],[0,0]],"state":"ingame","turn":"other","opponents":["bob"]}`},
+		{MsgRecoveryOpcode, "ok;recovery_ingame_gameover;1|1--2|2;bob;bob", `{"op":"012","status":"ok","board":[[1,1],[2,2]],"state":"gameover","result":"win","winners":["bob"],"opponents":["bob"]}`},
+		{MsgPauseOpcode, "ok;", `{"op":"013","status":"ok"}`},
+		{MsgContinueOpcode, "ok;", `{"op":"014","status":"ok"}`},
+		{MsgStatusOpcode, "ok;Opponent has lost connection.", `{"op":"015","status":"ok","message":"Opponent has lost connection."}`},
+		{MsgHelloOpcode, "ok;2;", `{"op":"016","status":"ok","version":2}`},
+		{MsgHelloOpcode, "ok;2;heartbeat", `{"op":"016","status":"ok","version":2,"capabilities":["heartbeat"]}`},
+		{MsgHeartbeatOpcode, "ok;4;bob=12,carol=30", `{"op":"017","status":"ok","seq":4,"rtts":[{"name":"bob","ms":12},{"name":"carol","ms":30}]}`},
+		{MsgClaimOpcode, "err;nothing to claim;criticalerror", `{"op":"018","status":"err","error":"nothing to claim","reason":"criticalerror"}`},
+
+		//arguments the fields cannot describe
+		{MsgMoveOpcode, "ok;not a board", `{"op":"003","status":"ok","args":["not a board"]}`},
+		{MsgPingOpcode, "extra", `{"op":"011","args":["extra"]}`},
+	}
+	for _, test := range tests {
+		frame := Frame{Opcode: test.opcode, Data: []byte(test.data)}
+		msg := encodeJSONFrame(frame)
+		bodyLen, err := parseJSONHeader(msg[:len(MsgMagicJSON)+MaxMsgDataLen])
+		body := string(msg[len(MsgMagicJSON)+MaxMsgDataLen:])
+		if err != nil || bodyLen != len(body) {
+			t.Errorf("%s %q: invalid header %q", test.opcode, test.data, msg[:len(MsgMagicJSON)+MaxMsgDataLen])
+		}
+		if body != test.body {
+			t.Errorf("%s %q encoded as %s, expected %s", test.opcode, test.data, body, test.body)
+		}
+		decoded, err := decodeJSONFrame([]byte(body))
+		if err != nil || decoded.Opcode != test.opcode || string(decoded.Data) != test.data {
+			t.Errorf("%s decoded as %s %q (%v), expected %s %q", body, decoded.Opcode, decoded.Data, err, test.opcode, test.data)
+		}
+	}
+}
+
+func TestJSONClientFields(t *testing.T) {
+	tests := []struct {
+		body string
+		data string
+		err  error
+	}{
+		{`{"op":"001","args":["alice"]}`, "alice", nil},
+		{`{"op":"003","args":[]}`, "", nil},
+		{`{"op":"003","x":1}`, "", nil},
+		{`{"op":"001","name":"a;b"}`, "", errJSONArg},
+		{`{"op":"002","gameType":"classic","rules":["size=4;misere"]}`, "", errJSONArg},
+		{`{"op":"001","args":["a;b"]}`, "", errJSONArg},
+	}
+	for _, test := range tests {
+		frame, err := decodeJSONFrame([]byte(test.body))
+		if err != test.err || (err == nil && string(frame.Data) != test.data) {
+			t.Errorf("%s decoded as %q (%v), expected %q (%v)", test.body, frame.Data, err, test.data, test.err)
+		}
+	}
+	if _, err := decodeJSONFrame([]byte(`{"op":"001","status":"maybe"}`)); err == nil {
+		t.Error("message with unknown status decoded")
+	}
+}
@@ -0,0 +1,205 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// opcode classes with separate rate limits
+const (
+	opClassPing  = "ping"
+	opClassLogin = "login" // hello, login and recovery, limits name guessing
+	opClassGame  = "game"  // everything else
+)
+
+// rate (tokens per second) and burst of token buckets by opcode class
+var opClassLimits = map[string]struct{ rate, burst float64 }{
+	opClassPing:  {PingRateLimit, PingRateBurst},
+	opClassLogin: {LoginRateLimit, LoginRateBurst},
+	opClassGame:  {GameRateLimit, GameRateBurst},
+}
+
+// limitError is an error of rejected connection or message, reason is sent to the client as last argument.
+type limitError struct {
+	msg    string
+	reason string
+}
+
+func (e *limitError) Error() string {
+	return e.msg + ArgSep + e.reason
+}
+
+// tokenBucket allows burst messages at once and rate messages per second on average.
+type tokenBucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{tokens: burst, rate: rate, burst: burst, last: Now()}
+}
+
+// allow takes one token if available.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connLimiter rate limits messages of one connection, used only by its ProcessClient goroutine.
+type connLimiter struct {
+	buckets map[string]*tokenBucket
+}
+
+func newConnLimiter() *connLimiter {
+	buckets := make(map[string]*tokenBucket, len(opClassLimits))
+	for class, limit := range opClassLimits {
+		buckets[class] = newTokenBucket(limit.rate, limit.burst)
+	}
+	return &connLimiter{buckets: buckets}
+}
+
+// allow returns error if client sends messages of opcode class too fast.
+func (l *connLimiter) allow(opcode string) error {
+	class := getOpClass(opcode)
+	if !l.buckets[class].allow(Now()) {
+		return &limitError{msg: "too many " + class + " messages", reason: SrvErrRateLimited}
+	}
+	return nil
+}
+
+// getOpClass returns rate limit class of opcode.
+func getOpClass(opcode string) string {
+	switch opcode {
+	case MsgPingOpcode, MsgHeartbeatOpcode:
+		return opClassPing
+	case MsgLoginOpcode, MsgRecoveryOpcode, MsgHelloOpcode:
+		return opClassLogin
+	default:
+		return opClassGame
+	}
+}
+
+// connCounter counts open connections, connections per IP address and connections without logged in player.
+type connCounter struct {
+	perIP     map[string]int
+	unauth    int
+	total     int
+	maxTotal  int
+	maxPerIP  int
+	maxUnauth int
+	mu        sync.Mutex
+}
+
+var connections = &connCounter{perIP: make(map[string]int), maxTotal: MaxConns, maxPerIP: MaxConnsPerIP, maxUnauth: MaxUnauthConns}
+
+// ConfigureCapacity sets max number of logged in players, open connections, open connections from one IP address
+// and open connections without logged in player. Players and connections are limited separately, connections
+// of players that dropped and have not recovered yet are closed while the players stay logged in.
+// It must be called before clients connect.
+func ConfigureCapacity(maxPlayers int, maxConns int, maxConnsPerIP int, maxUnauthConns int) error {
+	if maxPlayers < 1 || maxConns < 1 || maxConnsPerIP < 1 || maxUnauthConns < 1 {
+		return fmt.Errorf("capacity must be positive")
+	}
+	players.setMaxPlayers(maxPlayers)
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	connections.maxTotal = maxConns
+	connections.maxPerIP = maxConnsPerIP
+	connections.maxUnauth = maxUnauthConns
+	return nil
+}
+
+// AdmitConnection checks connection, per IP and unauthenticated connection limits for accepted connection
+// and counts it. Admitted connection is released by ProcessClient.
+func AdmitConnection(c Transport) error {
+	key := getConnKey(c)
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	if connections.total >= connections.maxTotal {
+		metrics.limitRejections.inc(SrvErrServerBusy)
+		return &limitError{msg: "too many connections", reason: SrvErrServerBusy}
+	}
+	if connections.perIP[key] >= connections.maxPerIP && !isPeerIP(getAddrIP(c.RemoteAddr())) {
+		metrics.limitRejections.inc(SrvErrTooManyConns)
+		return &limitError{msg: fmt.Sprintf("too many connections from %s", key), reason: SrvErrTooManyConns}
+	}
+	if connections.unauth >= connections.maxUnauth {
+		metrics.limitRejections.inc(SrvErrServerBusy)
+		return &limitError{msg: "too many connections waiting for login", reason: SrvErrServerBusy}
+	}
+	connections.perIP[key]++
+	connections.unauth++
+	connections.total++
+	return nil
+}
+
+// RejectConnection sends reason of rejection to the client and closes the connection.
+func RejectConnection(c Transport, err error) {
+	sendMsg(c, createOpCode(MsgErrOpcode, false, err.Error()), 1)
+	c.Close()
+}
+
+// connAuthenticated stops counting connection as unauthenticated after login.
+func connAuthenticated() {
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	connections.unauth--
+}
+
+// releaseConnection stops counting closed connection.
+func releaseConnection(c Transport, authenticated bool) {
+	key := getConnKey(c)
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	if !authenticated {
+		connections.unauth--
+	}
+	connections.total--
+	connections.perIP[key]--
+	if connections.perIP[key] <= 0 {
+		delete(connections.perIP, key)
+	}
+}
+
+// relayConnection counts connection relayed by another instance for the client address instead of the instance.
+func relayConnection(c Transport, client net.Addr) error {
+	from := getConnKey(c)
+	to := getAddrKey(client)
+	connections.mu.Lock()
+	defer connections.mu.Unlock()
+	if connections.perIP[to] >= connections.maxPerIP {
+		metrics.limitRejections.inc(SrvErrTooManyConns)
+		return &limitError{msg: fmt.Sprintf("too many connections from %s", to), reason: SrvErrTooManyConns}
+	}
+	connections.perIP[from]--
+	if connections.perIP[from] <= 0 {
+		delete(connections.perIP, from)
+	}
+	connections.perIP[to]++
+	return nil
+}
+
+// getConnKey returns IP address of the connection used to count connections per IP.
+func getConnKey(c Transport) string {
+	return getAddrKey(c.RemoteAddr())
+}
+
+// getAddrKey returns IP address of addr, or whole addr if it has none.
+func getAddrKey(addr net.Addr) string {
+	if ip := getAddrIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr.String()
+}
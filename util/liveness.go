@@ -0,0 +1,224 @@
+package util
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Liveness of logged in players is watched by one manager goroutine with a heap of deadlines instead of
+// goroutines polling every player. Each watched player has one deadline computed from the last ping:
+//
+//	connected player:    last ping + ping time * MaxNoPingReceived, then it is marked as disconnected
+//	                     and its opponents get pause
+//	disconnected player: last ping + MaxSecondsBeforeDisconnect, then it is removed (playerDisconnected),
+//	                     its game in play ends earlier if grace rule of the game is shorter (see grace.go)
+//
+// Connected players with heartbeat capability also get heartbeat every ping time (see heartbeat.go),
+// their echo is handled as a ping. Ping, echo and recovery only move the deadline.
+// Deadlines are measured and awaited by the server clock (see clock.go).
+
+// livenessEntry is a deadline of one watched player.
+type livenessEntry struct {
+	player   *Player
+	deadline time.Time
+	index    int //index in heap, -1 when not queued
+}
+
+// livenessHeap orders entries by deadline.
+type livenessHeap []*livenessEntry
+
+func (h livenessHeap) Len() int           { return len(h) }
+func (h livenessHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h livenessHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *livenessHeap) Push(x interface{}) {
+	entry := x.(*livenessEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+func (h *livenessHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// livenessManager fires liveness events of watched players.
+// Its methods are called with stateMutex held, mu is taken after it.
+type livenessManager struct {
+	entries map[*Player]*livenessEntry
+	queue   livenessHeap
+	wake    chan struct{} //wakes the manager when the earliest deadline changes
+	start   sync.Once     //manager goroutine is started with the first watched player
+	mu      sync.Mutex
+}
+
+var liveness = newLivenessManager()
+
+func newLivenessManager() *livenessManager {
+	return &livenessManager{entries: make(map[*Player]*livenessEntry), wake: make(chan struct{}, 1)}
+}
+
+// watch starts watching logged in player. Caller must hold stateMutex.
+func (m *livenessManager) watch(player *Player) {
+	m.start.Do(func() { go m.run() })
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[player]; !ok {
+		m.entries[player] = &livenessEntry{player: player, index: -1}
+	}
+	m.schedule(player)
+}
+
+// ping moves deadline of the player after ping, recovery or relogin. Caller must hold stateMutex.
+func (m *livenessManager) ping(player *Player) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schedule(player)
+}
+
+// forget stops watching the player. Caller must hold stateMutex.
+func (m *livenessManager) forget(player *Player) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[player]
+	if !ok {
+		return
+	}
+	if entry.index != -1 {
+		heap.Remove(&m.queue, entry.index)
+	}
+	delete(m.entries, player)
+}
+
+// schedule sets deadline of watched player from its last ping and connected flag.
+// Caller must hold stateMutex and m.mu.
+func (m *livenessManager) schedule(player *Player) {
+	entry, ok := m.entries[player]
+	if !ok {
+		return
+	}
+	entry.deadline = getLivenessDeadline(player)
+	if entry.index == -1 {
+		heap.Push(&m.queue, entry)
+	} else {
+		heap.Fix(&m.queue, entry.index)
+	}
+	if m.queue[0] == entry {
+		m.wakeUp()
+	}
+}
+
+// wakeUp makes the manager wait for the earliest deadline again.
+func (m *livenessManager) wakeUp() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run waits for the earliest deadline and fires its event.
+func (m *livenessManager) run() {
+	for {
+		m.mu.Lock()
+		wait := time.Hour
+		var due *Player
+		if len(m.queue) > 0 {
+			wait = m.queue[0].deadline.Sub(Now())
+			if wait <= 0 {
+				due = heap.Pop(&m.queue).(*livenessEntry).player
+			}
+		}
+		m.mu.Unlock()
+		if due != nil {
+			m.fire(due)
+			continue
+		}
+		timer := getClock().NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-m.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// fire handles expired deadline of the player, ping received meanwhile only moves the deadline again.
+func (m *livenessManager) fire(player *Player) {
+	stateMutex.Lock()
+	m.mu.Lock()
+	_, watched := m.entries[player]
+	m.mu.Unlock()
+	if !watched {
+		stateMutex.Unlock()
+		return
+	}
+	//conditions hold from the deadline on, otherwise the event would fire again until the clock moves
+	if player.getTimeSinceLastPing() >= time.Second*MaxSecondsBeforeDisconnect {
+		playerLog(player).Info("player timed out, closing connection")
+		metrics.pingTimeouts.inc(timeoutDisconnect)
+		conn := player.Conn
+		playerDisconnected(player)
+		stateMutex.Unlock()
+		if conn != nil {
+			if err := conn.Close(); err != nil {
+				Log.Warn("could not close connection", F(logKeyError, err))
+			}
+		}
+		return
+	}
+	if grace := getGraceDeadline(player); !grace.IsZero() && !Now().Before(grace) {
+		endGameWithout(findGame(player), []*Player{player}, EndReasonGrace)
+	} else if player.Connected && player.getTimeSinceLastPing() >= getPingTime()*MaxNoPingReceived {
+		playerLostConnection(player)
+	} else if player.Connected && player.HasCapability(CapHeartbeat) && !Now().Before(getNextHeartbeat(player)) {
+		sendHeartbeat(player)
+	}
+	m.ping(player)
+	stateMutex.Unlock()
+}
+
+// getLivenessDeadline returns time of the next liveness event of the player. Caller must hold stateMutex.
+func getLivenessDeadline(player *Player) time.Time {
+	if player.Connected {
+		deadline := player.TimeSinceLastPing.Add(getPingTime() * MaxNoPingReceived)
+		if heartbeat := getNextHeartbeat(player); player.HasCapability(CapHeartbeat) && heartbeat.Before(deadline) {
+			return heartbeat
+		}
+		return deadline
+	}
+	deadline := player.TimeSinceLastPing.Add(time.Second * MaxSecondsBeforeDisconnect)
+	if grace := getGraceDeadline(player); !grace.IsZero() && grace.Before(deadline) {
+		return grace
+	}
+	return deadline
+}
+
+// playerLostConnection marks the player as disconnected and pauses the game of its opponents.
+// Caller must hold stateMutex.
+func playerLostConnection(player *Player) {
+	if !player.Connected {
+		return
+	}
+	player.Connected = false
+	player.disconnectedAt = Now()
+	playerLog(player).Info("player lost connection")
+	metrics.pingTimeouts.inc(timeoutMissedPings)
+	game := findGame(player)
+	if game == nil {
+		return
+	}
+	if drops := game.GetRules().Drops; drops != 0 && game.AddDisconnect(player) > drops {
+		endGameWithout(game, []*Player{player}, EndReasonDrops)
+		return
+	}
+	for _, otherPlayer := range game.GetOtherPlayers(player) {
+		informPlayerAboutDisconnect(otherPlayer)
+	}
+}
@@ -0,0 +1,229 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// log levels
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// log output formats
+const (
+	LogFormatLogfmt = iota
+	LogFormatJSON
+)
+
+// log field keys
+const (
+	logKeyRemote   = "remote"
+	logKeyClientId = "client_id"
+	logKeyPlayerId = "player_id"
+	logKeyGameId   = "game_id"
+	logKeyOpcode   = "opcode"
+	logKeyPayload  = "payload"
+	logKeyError    = "error"
+	logRedacted    = "[redacted]"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// values of these keys are never written to the log
+var redactedKeys = map[string]bool{"password": true, "chat": true}
+
+// Log is the server logger, level and format can be changed at runtime.
+var Log = NewLogger(os.Stderr, LevelInfo, LogFormatLogfmt)
+
+// Field is a key-value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates a log field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger writes leveled structured log entries in logfmt or JSON format.
+// Loggers created by With share output, level and format with their parent.
+type Logger struct {
+	sink   *logSink
+	fields []Field
+}
+
+// logSink is the part of logger shared by parent and child loggers.
+type logSink struct {
+	out    io.Writer
+	level  int32
+	format int32
+	mu     sync.Mutex
+}
+
+// NewLogger creates a logger writing to out.
+func NewLogger(out io.Writer, level int, format int) *Logger {
+	return &Logger{sink: &logSink{out: out, level: int32(level), format: int32(format)}}
+}
+
+// ParseLogLevel converts level name (debug, info, warn, error) to level.
+func ParseLogLevel(name string) (int, error) {
+	for i, v := range levelNames {
+		if v == strings.ToLower(name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s", name)
+}
+
+// ParseLogFormat converts format name (logfmt, json) to format.
+func ParseLogFormat(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "logfmt":
+		return LogFormatLogfmt, nil
+	case "json":
+		return LogFormatJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown log format %s", name)
+	}
+}
+
+// SetLevel changes the minimal level of written entries.
+func (l *Logger) SetLevel(level int) {
+	atomic.StoreInt32(&l.sink.level, int32(level))
+}
+
+// GetLevelName returns name of the current level.
+func (l *Logger) GetLevelName() string {
+	return levelNames[atomic.LoadInt32(&l.sink.level)]
+}
+
+// SetFormat changes the output format.
+func (l *Logger) SetFormat(format int) {
+	atomic.StoreInt32(&l.sink.format, int32(format))
+}
+
+// SetOutput changes where the entries are written.
+func (l *Logger) SetOutput(out io.Writer) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.out = out
+}
+
+// With returns a logger adding the given fields to every entry.
+func (l *Logger) With(fields ...Field) *Logger {
+	return &Logger{sink: l.sink, fields: append(append(make([]Field, 0, len(l.fields)+len(fields)), l.fields...), fields...)}
+}
+
+// Debug, Info, Warn and Error write entry with the given level.
+func (l *Logger) Debug(msg string, fields ...Field) { l.write(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Field)  { l.write(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Field)  { l.write(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Field) { l.write(LevelError, msg, fields) }
+
+// write formats and writes one entry if level is enabled.
+func (l *Logger) write(level int, msg string, fields []Field) {
+	if int32(level) < atomic.LoadInt32(&l.sink.level) {
+		return
+	}
+	all := make([]Field, 0, 3+len(l.fields)+len(fields))
+	all = append(all, F("time", time.Now().Format(time.RFC3339Nano)), F("level", levelNames[level]), F("msg", msg))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+
+	var line string
+	if atomic.LoadInt32(&l.sink.format) == LogFormatJSON {
+		line = formatJSON(all)
+	} else {
+		line = formatLogfmt(all)
+	}
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	io.WriteString(l.sink.out, line+"\n")
+}
+
+// formatLogfmt formats fields as key=value pairs, values with spaces or quotes are quoted.
+func formatLogfmt(fields []Field) string {
+	var b strings.Builder
+	for i, f := range fields {
+		if i != 0 {
+			b.WriteByte(' ')
+		}
+		value := fieldValue(f)
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(f.Key + "=" + value)
+	}
+	return b.String()
+}
+
+// formatJSON formats fields as JSON object keeping their order.
+func formatJSON(fields []Field) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.Key)
+		value, err := json.Marshal(f.Value)
+		if _, isErr := f.Value.(error); isErr || err != nil || redactedKeys[f.Key] {
+			value, _ = json.Marshal(fieldValue(f))
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// fieldValue returns field value as string, redacted keys are hidden.
+func fieldValue(f Field) string {
+	if redactedKeys[f.Key] {
+		return logRedacted
+	}
+	if err, ok := f.Value.(error); ok {
+		return err.Error()
+	}
+	return fmt.Sprint(f.Value)
+}
+
+// redactPayload hides message data that must not be logged.
+// Login carries name and optionally password, only the name is kept.
+func redactPayload(opcode string, data string) string {
+	if opcode == MsgLoginOpcode {
+		args := strings.SplitN(data, ArgSep, 2)
+		if len(args) > 1 {
+			return args[0] + ArgSep + logRedacted
+		}
+	}
+	return data
+}
+
+// playerLog returns logger with connection, player and game of the player attached.
+func playerLog(player *Player) *Logger {
+	fields := []Field{F(logKeyClientId, player.ClientId)}
+	if player.Conn != nil {
+		fields = append(fields, F(logKeyRemote, player.Conn.RemoteAddr().String()))
+	}
+	if player.Id != 0 {
+		fields = append(fields, F(logKeyPlayerId, player.Id))
+		if game := findGame(player); game != nil {
+			fields = append(fields, F(logKeyGameId, game.GetId()))
+		}
+	}
+	return Log.With(fields...)
+}
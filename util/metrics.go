@@ -0,0 +1,206 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds (seconds) of operation latency histogram buckets
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// game state label values
+var gameStateNames = map[int]string{WaitingForPlayersReady: "waiting", WaitingForMove: "playing", GameOver: "over"}
+
+// game finished result label values
+const (
+	resultWin          = "win"
+	resultDraw         = "draw"
+	resultDisconnected = "disconnected"
+	resultAborted      = "aborted"
+)
+
+// ping timeout kind label values
+const (
+	timeoutMissedPings = "missed_pings" // player marked as disconnected, game paused
+	timeoutDisconnect  = "disconnect"   // player removed from server
+)
+
+// serverMetrics holds counters of the running server exposed in Prometheus text format.
+type serverMetrics struct {
+	connectedClients   int64
+	invalidOpKicks     uint64
+	recoveryHandshakes uint64
+	gamesFinished      *counterVec
+	messagesReceived   *counterVec
+	messagesSent       *counterVec
+	pingTimeouts       *counterVec
+	limitRejections    *counterVec
+	outboundFailures   *counterVec
+	operationDuration  *histogramVec
+}
+
+// counterVec is a counter with one label.
+type counterVec struct {
+	values map[string]uint64
+	mu     sync.Mutex
+}
+
+// histogram counts observations in latencyBuckets.
+type histogram struct {
+	buckets []uint64 // not cumulative, last bucket is +Inf
+	sum     float64
+	count   uint64
+}
+
+// histogramVec is a histogram with one label.
+type histogramVec struct {
+	values map[string]*histogram
+	mu     sync.Mutex
+}
+
+var metrics = newServerMetrics()
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		gamesFinished:     &counterVec{values: make(map[string]uint64)},
+		messagesReceived:  &counterVec{values: make(map[string]uint64)},
+		messagesSent:      &counterVec{values: make(map[string]uint64)},
+		pingTimeouts:      &counterVec{values: make(map[string]uint64)},
+		limitRejections:   &counterVec{values: make(map[string]uint64)},
+		outboundFailures:  &counterVec{values: make(map[string]uint64)},
+		operationDuration: &histogramVec{values: make(map[string]*histogram)},
+	}
+}
+
+func (c *counterVec) inc(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[label]++
+}
+
+// snapshot returns copy of values sorted by label.
+func (c *counterVec) snapshot() ([]string, map[string]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make(map[string]uint64, len(c.values))
+	labels := make([]string, 0, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	return labels, values
+}
+
+func (h *histogramVec) observe(label string, d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[label]
+	if !ok {
+		hist = &histogram{buckets: make([]uint64, len(latencyBuckets)+1)}
+		h.values[label] = hist
+	}
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	hist.buckets[i]++
+	hist.sum += seconds
+	hist.count++
+}
+
+// MetricsHandler returns handler serving server metrics in Prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+}
+
+// write writes all metrics in Prometheus text format.
+func (m *serverMetrics) write(w io.Writer) {
+	writeHeader(w, "kivups_connected_clients", "gauge", "Number of open client connections.")
+	fmt.Fprintf(w, "kivups_connected_clients %d\n", atomic.LoadInt64(&m.connectedClients))
+
+	writeHeader(w, "kivups_logged_in_players", "gauge", "Number of logged in players.")
+	fmt.Fprintf(w, "kivups_logged_in_players %d\n", players.GetPlayersCount())
+
+	writeHeader(w, "kivups_games", "gauge", "Number of active games by state.")
+	gameCounts := make(map[int]int)
+	gameListMutex.Lock()
+	for _, v := range availableGamesList {
+		gameCounts[v.GetState()]++
+	}
+	gameListMutex.Unlock()
+	for _, state := range []int{WaitingForPlayersReady, WaitingForMove, GameOver} {
+		fmt.Fprintf(w, "kivups_games{state=%q} %d\n", gameStateNames[state], gameCounts[state])
+	}
+
+	writeCounterVec(w, "kivups_games_finished_total", "Number of finished games by result.", "result", m.gamesFinished)
+	writeCounterVec(w, "kivups_messages_received_total", "Number of messages received by opcode.", "opcode", m.messagesReceived)
+	writeCounterVec(w, "kivups_messages_sent_total", "Number of messages sent by opcode.", "opcode", m.messagesSent)
+
+	writeHeader(w, "kivups_invalid_op_kicks_total", "counter", "Number of clients disconnected for too many invalid operations.")
+	fmt.Fprintf(w, "kivups_invalid_op_kicks_total %d\n", atomic.LoadUint64(&m.invalidOpKicks))
+
+	writeCounterVec(w, "kivups_ping_timeouts_total", "Number of ping timeouts by kind.", "kind", m.pingTimeouts)
+
+	writeCounterVec(w, "kivups_limit_rejections_total", "Number of connections and messages rejected by limits by reason.", "reason", m.limitRejections)
+
+	writeCounterVec(w, "kivups_outbound_failures_total", "Number of outbound messages not sent to slow or broken clients by reason.", "reason", m.outboundFailures)
+
+	writeHeader(w, "kivups_recovery_handshakes_total", "counter", "Number of completed recovery handshakes.")
+	fmt.Fprintf(w, "kivups_recovery_handshakes_total %d\n", atomic.LoadUint64(&m.recoveryHandshakes))
+
+	writeHeader(w, "kivups_operation_duration_seconds", "histogram", "Time spent handling operation by opcode.")
+	m.operationDuration.mu.Lock()
+	defer m.operationDuration.mu.Unlock()
+	labels := make([]string, 0, len(m.operationDuration.values))
+	for k := range m.operationDuration.values {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		hist := m.operationDuration.values[label]
+		cumulative := uint64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += hist.buckets[i]
+			fmt.Fprintf(w, "kivups_operation_duration_seconds_bucket{opcode=%q,le=\"%g\"} %d\n", label, bound, cumulative)
+		}
+		fmt.Fprintf(w, "kivups_operation_duration_seconds_bucket{opcode=%q,le=\"+Inf\"} %d\n", label, hist.count)
+		fmt.Fprintf(w, "kivups_operation_duration_seconds_sum{opcode=%q} %g\n", label, hist.sum)
+		fmt.Fprintf(w, "kivups_operation_duration_seconds_count{opcode=%q} %d\n", label, hist.count)
+	}
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounterVec(w io.Writer, name string, help string, labelName string, c *counterVec) {
+	writeHeader(w, name, "counter", help)
+	labels, values := c.snapshot()
+	for _, label := range labels {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, labelName, label, values[label])
+	}
+}
+
+// opcodes used as label values, anything else is counted as unknown to keep label cardinality bounded
+var knownOpcodes = map[string]bool{
+	MsgLoginOpcode: true, MsgJoinOpcode: true, MsgMoveOpcode: true, MsgPlayAgainOpcode: true,
+	MsgGameStartedOpcode: true, MsgReturnToStartOpcode: true, MsgGameOverOpcode: true, MsgOkOpcode: true,
+	MsgErrOpcode: true, MsgYourTurnOpcode: true, MsgPingOpcode: true, MsgRecoveryOpcode: true,
+	MsgPauseOpcode: true, MsgContinueOpcode: true, MsgStatusOpcode: true, MsgHelloOpcode: true,
+	MsgHeartbeatOpcode: true, MsgClaimOpcode: true,
+}
+
+// getOpcodeLabel returns opcode label value for metrics.
+func getOpcodeLabel(opcode string) string {
+	if knownOpcodes[opcode] {
+		return opcode
+	}
+	return "unknown"
+}
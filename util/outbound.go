@@ -0,0 +1,142 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// backpressure policies applied when outbound queue of a client is full
+const (
+	BackpressureDisconnect = "disconnect" //close connection of the slow client
+	BackpressureDrop       = "drop"       //drop the message, the client misses it
+)
+
+// outbound failure label values
+const (
+	outboundQueueFull    = "queue_full"
+	outboundWriteTimeout = "write_timeout"
+	outboundWriteError   = "write_error"
+)
+
+var (
+	errTransportClosed = errors.New("connection closed")
+	errQueueFull       = errors.New("outbound queue full")
+)
+
+// outboundConfig configures queues of transports created afterwards.
+type outboundConfig struct {
+	queueLen     int
+	writeTimeout time.Duration
+	policy       string
+}
+
+var outbound = outboundConfig{queueLen: OutboundQueueLen, writeTimeout: time.Second * WriteTimeout, policy: BackpressureDisconnect}
+
+// ConfigureOutbound sets queue length, write timeout and backpressure policy of client connections.
+// It must be called before clients connect.
+func ConfigureOutbound(queueLen int, writeTimeout time.Duration, policy string) error {
+	if queueLen < 1 {
+		return fmt.Errorf("queue length must be positive")
+	}
+	if writeTimeout <= 0 {
+		return fmt.Errorf("write timeout must be positive")
+	}
+	if policy != BackpressureDisconnect && policy != BackpressureDrop {
+		return fmt.Errorf("unknown backpressure policy %s", policy)
+	}
+	outbound = outboundConfig{queueLen: queueLen, writeTimeout: writeTimeout, policy: policy}
+	return nil
+}
+
+// queuedTransport queues written frames, a single writer goroutine sends them to the client,
+// so a stalled client never blocks goroutines of other players.
+type queuedTransport struct {
+	Transport
+	config outboundConfig
+	queue  chan Frame
+	closed bool //no more frames are accepted
+	failed bool //connection was closed because of slow or broken client
+	mu     sync.Mutex
+}
+
+// newQueuedTransport wraps transport with outbound queue and starts its writer.
+func newQueuedTransport(t Transport) Transport {
+	q := &queuedTransport{Transport: t, config: outbound, queue: make(chan Frame, outbound.queueLen)}
+	go q.writer()
+	return q
+}
+
+// WriteFrame queues frame without blocking.
+func (q *queuedTransport) WriteFrame(frame Frame) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.failed {
+		return errTransportClosed
+	}
+	select {
+	case q.queue <- frame:
+		return nil
+	default:
+	}
+	metrics.outboundFailures.inc(outboundQueueFull)
+	if q.config.policy == BackpressureDrop {
+		return errQueueFull
+	}
+	q.fail(outboundQueueFull)
+	return errQueueFull
+}
+
+// writer sends queued frames, after Close it sends the rest and closes the connection.
+func (q *queuedTransport) writer() {
+	for frame := range q.queue {
+		q.Transport.SetWriteDeadline(time.Now().Add(q.config.writeTimeout))
+		err := q.Transport.WriteFrame(frame)
+		if err != nil {
+			reason := outboundWriteError
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				reason = outboundWriteTimeout
+			}
+			q.mu.Lock()
+			if !q.failed { //not closed by WriteFrame already
+				metrics.outboundFailures.inc(reason)
+				q.fail(reason)
+			}
+			q.mu.Unlock()
+			for range q.queue {
+				//discard frames until Close
+			}
+			return
+		}
+	}
+	q.Transport.Close()
+}
+
+// fail closes connection of slow or broken client, caller must hold q.mu.
+func (q *queuedTransport) fail(reason string) {
+	if q.failed {
+		return
+	}
+	q.failed = true
+	Log.Info("closing connection of slow or broken client", F(logKeyRemote, q.RemoteAddr().String()), F("reason", reason))
+	q.Transport.Close() //also unblocks reader and writer
+}
+
+// Close stops accepting frames, the connection is closed after queued frames are sent.
+func (q *queuedTransport) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errTransportClosed
+	}
+	q.closed = true
+	close(q.queue)
+	return nil
+}
+
+// SetWriteDeadline does nothing, the writer uses write timeout for every frame.
+func (q *queuedTransport) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -2,96 +2,117 @@ package util
 
 import (
 	"errors"
-	"net"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Player fields are guarded by stateMutex (see server.go), registry Players by its own mutex.
 type Player struct {
-	Id                int       // 0 means not invalid or empty player
-	Name              string    // name of the player
-	Conn              *net.Conn // connection of the player
-	ClientId          int       // client id of the player (kinda useless but whatever)
-	TimeSinceLastPing time.Time // time since last ping
-	Status            int       // status of the player
-	Connected         bool      // is player connected
+	Id                int             // 0 means not invalid or empty player
+	Name              string          // name of the player
+	Conn              Transport       // connection of the player
+	ClientId          int             // client id of the player (kinda useless but whatever)
+	TimeSinceLastPing time.Time       // time since last ping
+	Status            int             // status of the player
+	Connected         bool            // is player connected
+	Protocol          int             // protocol version negotiated by hello, 0 if client did not send it
+	Capabilities      map[string]bool // capabilities negotiated by hello
+	Rtt               time.Duration   // round-trip time measured by the last heartbeat, 0 if not measured
+	heartbeatSeq      int             // sequence number of the last heartbeat sent to the client
+	heartbeatSent     time.Time       // time the last heartbeat was sent
+	disconnectedAt    time.Time       // time the player was marked as disconnected
 }
 
+// Players is the registry of logged in players indexed by id, name and client id.
+// Logged out players are removed from it.
 type Players struct {
-	PlayerId int        // id of the player
-	Players  []*Player  // slice of players (ptr)
-	mu       sync.Mutex // mutex for thread safety
+	PlayerId   int                // id of the next player
+	maxPlayers int                // max number of logged in players
+	byId       map[int]*Player    // players by id
+	byName     map[string]*Player // players by name
+	byClientId map[int]*Player    // players by client id of their current connection
+	mu         sync.Mutex         // mutex for thread safety
 }
 
 // Gets duration since last ping
 func (q *Player) getTimeSinceLastPing() time.Duration {
-	return time.Since(q.TimeSinceLastPing)
+	return Now().Sub(q.TimeSinceLastPing)
 }
 
 func NewPlayers() *Players {
-	return &Players{PlayerId: 1, Players: make([]*Player, 0)}
+	return &Players{PlayerId: 1, maxPlayers: MaxClients, byId: make(map[int]*Player), byName: make(map[string]*Player),
+		byClientId: make(map[int]*Player)}
 }
 
 func NewPlayer() *Player {
-	return &Player{Id: 0, Name: "", Conn: nil, ClientId: 0, TimeSinceLastPing: time.Now(), Status: InLobby, Connected: true}
+	return &Player{Id: 0, Name: "", Conn: nil, ClientId: 0, TimeSinceLastPing: Now(), Status: InLobby, Connected: true}
 }
 
-func (q *Players) GetPlayerIndexByName(name string) int {
+// GetPlayerByName returns logged in player with the given name or nil.
+func (q *Players) GetPlayerByName(name string) *Player {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	for i, v := range q.Players {
-		if v.Name == name {
-			return i
-		}
-	}
-	return -1
+	return q.byName[name]
 }
 
-func (q *Players) GetPlayerIndexByPtr(player *Player) int {
+// GetPlayerById returns logged in player with the given id or nil.
+func (q *Players) GetPlayerById(id int) *Player {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	for i, v := range q.Players {
-		if v == player {
-			return i
-		}
-	}
-	return -1
+	return q.byId[id]
 }
 
+// GetPlayerByClientId returns logged in player connected by the client with the given id or nil.
 func (q *Players) GetPlayerByClientId(clientId int) *Player {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	for _, v := range q.Players {
-		if v.ClientId == clientId {
-			return v
-		}
+	return q.byClientId[clientId]
+}
+
+// GetLoggedInPlayers returns logged in players ordered by id.
+func (q *Players) GetLoggedInPlayers() []*Player {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	result := make([]*Player, 0, len(q.byId))
+	for _, v := range q.byId {
+		result = append(result, v)
 	}
-	return nil
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
 }
 
 // Login searches for a player with the specified name in the Players and updates their connection information.
-// If a player with the specified name is found, their connection, last ping time is updated and the player is returned.
+// If a player with the specified name is found, their connection, client id, last ping time is updated and the player is returned.
 // If no player with the specified name is found, an error is returned.
-func (q *Players) Login(conn *net.Conn, name string, player *Player) (*Player, error) {
+func (q *Players) Login(conn Transport, name string, player *Player) (*Player, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	for _, v := range q.Players {
-		if v.Name == name {
-			v.Conn = conn
-			v.TimeSinceLastPing = time.Now()
-			return v, nil
-		}
+	v, ok := q.byName[name]
+	if !ok {
+		return nil, errors.New("player not found")
+	}
+	if q.byClientId[v.ClientId] == v {
+		delete(q.byClientId, v.ClientId)
 	}
-	return nil, errors.New("player not found")
+	v.Conn = conn
+	v.ClientId = player.ClientId
+	v.Protocol = player.Protocol
+	v.Capabilities = player.Capabilities
+	v.TimeSinceLastPing = Now()
+	q.indexClientId(v)
+	return v, nil
 }
 
 // Does not set player.Conn and client id
-// Appends player to the end of the slice
+// Adds player to the registry
 func (q *Players) AddNewPlayer(player *Player) error {
-	if q.getPlayersLen() >= MaxClients {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.byId) >= q.maxPlayers {
 		return errors.New("max number of players reached")
 	}
-	if q.GetPlayerIndexByName(player.Name) != -1 {
+	if _, ok := q.byName[player.Name]; ok {
 		return errors.New("player with this name already exists")
 	}
 	if player.Conn == nil {
@@ -99,36 +120,49 @@ func (q *Players) AddNewPlayer(player *Player) error {
 	}
 
 	player.Id = q.PlayerId
-	player.TimeSinceLastPing = time.Now()
+	player.TimeSinceLastPing = Now()
 	player.Status = InLobby
 	player.Connected = true
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	q.Players = append(q.Players, player)
+	q.byId[player.Id] = player
+	q.byName[player.Name] = player
+	q.indexClientId(player)
 	q.PlayerId++
 	return nil
 }
 
-// Removes player from Players
+// indexClientId indexes player by client id of its connection, caller must hold q.mu.
+func (q *Players) indexClientId(player *Player) {
+	if player.ClientId != 0 {
+		q.byClientId[player.ClientId] = player
+	}
+}
+
+// Removes player from Players, the player is zeroed so holders of it see it logged out
 func (q *Players) Logout(player *Player) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	for i, v := range q.Players {
-		if v.Id == player.Id {
-			*q.Players[i] = Player{}
-			return
-		}
+	v, ok := q.byId[player.Id]
+	if !ok {
+		return
 	}
+	delete(q.byId, v.Id)
+	delete(q.byName, v.Name)
+	if q.byClientId[v.ClientId] == v {
+		delete(q.byClientId, v.ClientId)
+	}
+	*v = Player{}
 }
 
-func (q *Players) getPlayersLen() int {
-	//len(players) is always maxclients because of make
-	//so we need to count how many players are actually in the game
-	count := 0
-	for _, v := range q.Players {
-		if v.Id != 0 {
-			count++
-		}
-	}
-	return count
+// GetPlayersCount returns number of logged in players.
+func (q *Players) GetPlayersCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.byId)
+}
+
+// setMaxPlayers sets max number of logged in players.
+func (q *Players) setMaxPlayers(max int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.maxPlayers = max
 }
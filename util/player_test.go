@@ -0,0 +1,45 @@
+package util
+
+import "testing"
+
+func TestPlayersRegistry(t *testing.T) {
+	registry := NewPlayers()
+	registry.setMaxPlayers(2)
+	server, _ := NewPipeTransport()
+	alice := &Player{Name: "alice", Conn: server, ClientId: 10}
+	bob := &Player{Name: "bob", Conn: server, ClientId: 11}
+	for _, v := range []*Player{alice, bob} {
+		if err := registry.AddNewPlayer(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.AddNewPlayer(&Player{Name: "alice", Conn: server}); err == nil {
+		t.Error("player with taken name added")
+	}
+	if err := registry.AddNewPlayer(&Player{Name: "carol", Conn: server}); err == nil {
+		t.Error("player added over capacity")
+	}
+	if registry.GetPlayerByName("alice") != alice || registry.GetPlayerById(alice.Id) != alice || registry.GetPlayerByClientId(10) != alice {
+		t.Error("player not found by name, id and client id")
+	}
+
+	//relogin moves the player to the client id of the new connection
+	if v, err := registry.Login(server, "alice", &Player{ClientId: 12}); err != nil || v != alice {
+		t.Fatalf("relogin returned %v %v", v, err)
+	}
+	if registry.GetPlayerByClientId(10) != nil || registry.GetPlayerByClientId(12) != alice {
+		t.Error("client id index not moved to the new connection")
+	}
+
+	id := alice.Id
+	registry.Logout(alice)
+	if alice.Id != 0 || registry.GetPlayerByName("alice") != nil || registry.GetPlayerById(id) != nil || registry.GetPlayerByClientId(12) != nil {
+		t.Error("logged out player not removed")
+	}
+	if count := registry.GetPlayersCount(); count != 1 {
+		t.Errorf("%d players logged in, expected 1", count)
+	}
+	if err := registry.AddNewPlayer(&Player{Name: "carol", Conn: server}); err != nil {
+		t.Errorf("player not added after logout freed capacity: %v", err)
+	}
+}
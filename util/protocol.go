@@ -0,0 +1,59 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// capabilities known by this server, a client gets only those it announced in hello
+var knownCapabilities = map[string]bool{CapRules: true, CapHeartbeat: true}
+
+// negotiateProtocol checks protocol version and capabilities from hello arguments.
+// It returns version used for the client and capabilities supported by both sides.
+func negotiateProtocol(args []string) (int, map[string]bool, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return 0, nil, fmt.Errorf("wrong number of arguments" + ArgSep + SrvErrInvalidOp)
+	}
+	version, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, nil, fmt.Errorf("couldnt parse protocol version" + ArgSep + SrvErrInvalidOp)
+	}
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return 0, nil, fmt.Errorf("unsupported protocol version %d, server supports %d to %d"+ArgSep+SrvErrIncompatibleVersion,
+			version, MinProtocolVersion, ProtocolVersion)
+	}
+	capabilities := make(map[string]bool)
+	if len(args) == 2 {
+		for _, v := range strings.Split(args[1], capSep) {
+			if knownCapabilities[v] {
+				capabilities[v] = true
+			}
+		}
+	}
+	return version, capabilities, nil
+}
+
+// getCapabilityList returns sorted capabilities separated by capSep.
+func getCapabilityList(capabilities map[string]bool) string {
+	list := make([]string, 0, len(capabilities))
+	for k := range capabilities {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return strings.Join(list, capSep)
+}
+
+// HasCapability returns true if client of the player announced capability in hello.
+func (q *Player) HasCapability(capability string) bool {
+	return q.Capabilities[capability]
+}
+
+// GetProtocolVersion returns protocol version of the client, clients without hello use the oldest one.
+func (q *Player) GetProtocolVersion() int {
+	if q.Protocol == 0 {
+		return MinProtocolVersion
+	}
+	return q.Protocol
+}
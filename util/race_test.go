@@ -0,0 +1,155 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tests of concurrent clients and admin operations, run them with go test -race.
+
+// startAdminLoad reads and changes server state through admin operations until the returned function is called.
+func startAdminLoad() func() {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, v := range listGames() {
+				getGameInfo(findGameById(v.Id))
+			}
+			listPlayers()
+			metrics.write(ioutil.Discard)
+			broadcastStatus("load")
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// kickTestPlayers removes players left by a test.
+func kickTestPlayers(names ...string) {
+	for _, name := range names {
+		kickPlayer(name, "test finished")
+	}
+}
+
+// playTestGame plays one game of two clients, moves are taken in order from cells as players get their turn.
+func playTestGame(t *testing.T, names [2]string, join []string) {
+	cells := [][2]int{{0, 0}, {0, 1}, {0, 2}, {1, 0}, {1, 1}, {1, 2}, {2, 0}, {2, 1}, {2, 2}}
+	next := int32(-1)
+	clients := [2]*testClient{connectTestClient(t), connectTestClient(t)}
+	for i, c := range clients {
+		if response := c.login(names[i]); !strings.HasPrefix(response, ClientMsgOk) {
+			t.Errorf("login of %s failed: %s", names[i], response)
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *testClient) {
+			defer wg.Done()
+			c.send(MsgJoinOpcode, join...)
+			for {
+				select {
+				case frame, ok := <-c.frames:
+					if !ok {
+						t.Errorf("connection closed during game")
+						return
+					}
+					switch frame.Opcode {
+					case MsgYourTurnOpcode:
+						cell := cells[atomic.AddInt32(&next, 1)]
+						c.send(MsgMoveOpcode, fmt.Sprint(cell[0]), fmt.Sprint(cell[1]))
+					case MsgMoveOpcode, MsgJoinOpcode:
+						if strings.HasPrefix(string(frame.Data), ClientMsgErr) {
+							t.Errorf("operation %s failed: %s", frame.Opcode, frame.Data)
+						}
+					case MsgGameOverOpcode:
+						c.send(MsgReturnToStartOpcode)
+						c.expect(MsgReturnToStartOpcode)
+						return
+					}
+				case <-time.After(5 * time.Second):
+					t.Errorf("timeout during game")
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	for _, c := range clients {
+		c.conn.Close()
+	}
+}
+
+func TestConcurrentGames(t *testing.T) {
+	defer kickTestPlayers("race1a", "race1b", "race2a", "race2b")
+	stop := startAdminLoad()
+	defer stop()
+
+	for round := 0; round < 3; round++ {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			playTestGame(t, [2]string{"race1a", "race1b"}, []string{GameTypeClassic})
+		}()
+		go func() {
+			defer wg.Done()
+			playTestGame(t, [2]string{"race2a", "race2b"}, []string{GameTypeClassic, RuleMisere})
+		}()
+		wg.Wait()
+		kickTestPlayers("race1a", "race1b", "race2a", "race2b")
+	}
+}
+
+func TestConcurrentReconnect(t *testing.T) {
+	defer kickTestPlayers("recon1", "recon2")
+	stop := startAdminLoad()
+	defer stop()
+
+	first, second := connectTestClient(t), connectTestClient(t)
+	defer func() { second.conn.Close() }()
+	first.login("recon1")
+	second.login("recon2")
+	first.send(MsgJoinOpcode)
+	second.send(MsgJoinOpcode)
+	first.expect(MsgGameStartedOpcode)
+	second.expect(MsgGameStartedOpcode)
+
+	for i := 0; i < 3; i++ {
+		first.conn.Close()
+		first = connectTestClient(t)
+		if response := first.login("recon1"); !strings.Contains(response, ClientMsgRecoveryLogin) {
+			t.Fatalf("relogin response %q, expected recovery", response)
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			second.send(MsgPingOpcode)
+			second.expect(MsgContinueOpcode)
+		}()
+		first.send(MsgRecoveryOpcode)
+		if response := string(first.expect(MsgRecoveryOpcode).Data); !strings.Contains(response, "recovery_ingame") {
+			t.Errorf("recovery response %q, expected game state", response)
+		}
+		wg.Wait()
+	}
+	first.conn.Close()
+}
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rules holds rule options of a game. Players are matched only with players wanting the same rules.
+type Rules struct {
+	Misere    bool   // whoever completes a line loses
+	Wild      bool   // each move chooses which symbol to place
+	Seats     int    // number of players
+	BoardSize int    // size of the board (classic game only)
+	WinLength int    // symbols in a row needed to win (classic game only)
+	Grace     int    // seconds the game waits for a disconnected player, 0 waits until the player is removed
+	Drops     int    // disconnects allowed per player and game, 0 means unlimited
+	OnTimeout string // outcome of game ended because of disconnected player, empty means forfeit
+	Claim     bool   // player waiting for disconnected opponent may claim the win
+}
+
+// String returns rules in the format announced in game started message.
+func (r Rules) String() string {
+	names := make([]string, 0)
+	if r.Misere {
+		names = append(names, RuleMisere)
+	}
+	if r.Wild {
+		names = append(names, RuleWild)
+	}
+	if r.Seats != defaultSeats {
+		names = append(names, RuleSeats+strconv.Itoa(r.Seats))
+	}
+	if r.BoardSize != 0 && r.BoardSize != defaultBoardSize {
+		names = append(names, RuleSize+strconv.Itoa(r.BoardSize))
+	}
+	if r.WinLength != 0 && r.WinLength != r.BoardSize {
+		names = append(names, RuleLine+strconv.Itoa(r.WinLength))
+	}
+	if r.Grace != 0 {
+		names = append(names, RuleGrace+strconv.Itoa(r.Grace))
+	}
+	if r.Drops != 0 {
+		names = append(names, RuleDrops+strconv.Itoa(r.Drops))
+	}
+	if r.OnTimeout != "" {
+		names = append(names, RuleTimeout+r.OnTimeout)
+	}
+	if r.Claim {
+		names = append(names, RuleClaim)
+	}
+	if len(names) == 0 {
+		return RuleStandard
+	}
+	return strings.Join(names, ruleSep)
+}
+
+// parseRules parses rule options sent in join operation and fills in defaults for the game type.
+func parseRules(gameType int, args []string) (Rules, error) {
+	rules := Rules{}
+	for _, arg := range args {
+		var err error
+		switch {
+		case arg == RuleMisere:
+			rules.Misere = true
+		case arg == RuleWild:
+			rules.Wild = true
+		case arg == RuleClaim:
+			rules.Claim = true
+		case arg == RuleStandard:
+		case strings.HasPrefix(arg, RuleSeats):
+			rules.Seats, err = parseRuleValue(arg, RuleSeats, defaultSeats, maxSeats)
+		case strings.HasPrefix(arg, RuleSize):
+			rules.BoardSize, err = parseRuleValue(arg, RuleSize, minWinLength, maxBoardSize)
+		case strings.HasPrefix(arg, RuleLine):
+			rules.WinLength, err = parseRuleValue(arg, RuleLine, minWinLength, maxBoardSize)
+		case strings.HasPrefix(arg, RuleGrace):
+			rules.Grace, err = parseRuleValue(arg, RuleGrace, 1, MaxSecondsBeforeDisconnect)
+		case strings.HasPrefix(arg, RuleDrops):
+			rules.Drops, err = parseRuleValue(arg, RuleDrops, 1, maxDrops)
+		case strings.HasPrefix(arg, RuleTimeout):
+			rules.OnTimeout, err = parseTimeoutOutcome(arg)
+		default:
+			return Rules{}, fmt.Errorf("unknown rule %s", arg)
+		}
+		if err != nil {
+			return Rules{}, err
+		}
+	}
+
+	if gameType == UltimateGame {
+		if (rules.Seats != 0 && rules.Seats != ultimateSeats) || rules.BoardSize != 0 || rules.WinLength != 0 {
+			return Rules{}, fmt.Errorf("ultimate game has fixed seats and board")
+		}
+		rules.Seats = ultimateSeats
+		return rules, nil
+	}
+
+	if rules.Seats == 0 {
+		rules.Seats = defaultSeats
+	}
+	if rules.BoardSize == 0 {
+		rules.BoardSize = defaultBoardSize
+	}
+	if rules.WinLength == 0 {
+		rules.WinLength = rules.BoardSize
+	}
+	if rules.WinLength > rules.BoardSize {
+		return Rules{}, fmt.Errorf("line cannot be longer than board size")
+	}
+	return rules, nil
+}
+
+// parseRuleValue parses value of rule in form name=value and checks it is in range min..max.
+func parseRuleValue(arg string, name string, min int, max int) (int, error) {
+	value, err := strconv.Atoi(strings.TrimPrefix(arg, name))
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("invalid rule %s", arg)
+	}
+	return value, nil
+}
+
+// parseTimeoutOutcome parses timeout rule, forfeit is the default and is stored as empty string
+// so games with and without the rule are matched together.
+func parseTimeoutOutcome(arg string) (string, error) {
+	switch outcome := strings.TrimPrefix(arg, RuleTimeout); outcome {
+	case TimeoutForfeit:
+		return "", nil
+	case TimeoutAbort, TimeoutDraw:
+		return outcome, nil
+	default:
+		return "", fmt.Errorf("invalid rule %s", arg)
+	}
+}
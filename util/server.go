@@ -2,67 +2,54 @@ package util
 
 import (
 	"fmt"
-	"log"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var availableGamesList = make([]*TicTacToeGame, 0) //list of available games
 var gameListMutex = &sync.Mutex{}                  //mutex for availableGamesList (thread safety)
+var nextGameId = 1                                 //id of the next created game (guarded by gameListMutex)
+var gamesByPlayer = make(map[int]*TicTacToeGame)   //game of player by player id (guarded by gameListMutex)
+var pingTime = int64(PingTime)                     //time between pings in seconds, can be changed at runtime
 var players = NewPlayers()                         //list of players
+var lastClientId int64                             //id of the last accepted client
 
-// readAll reads data from the connection until the specified data length is reached.
-// It returns the read data, the total number of bytes read, and any error encountered.
-// If the data length exceeds the maximum allowed size, it returns an error.
-// If a timeout is specified, it sets a read deadline on the connection.
-// The read deadline is cleared before returning.
-func readAll(connection *net.Conn, dataLen int, timeout int) ([]byte, int, error) {
-	totalBytesRead := 0
-	conn := *connection
-	buffer := make([]byte, dataLen)
+// stateMutex serializes everything that reads or changes players and their games: operations of clients,
+// liveness handlers and admin operations. It is taken before gameListMutex, TicTacToeGame.mu and Players.mu.
+// Messages are only queued while it is held (see outbound.go), so a slow client cannot stall others.
+var stateMutex = &sync.Mutex{}
 
-	if dataLen > MaxDataLen {
-		return nil, 0, fmt.Errorf("data size is too large")
-	}
-	if timeout != 0 {
-		conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(timeout)))
-	}
-
-	for totalBytesRead < dataLen {
-		bytesRead, err := conn.Read(buffer[totalBytesRead:])
-		//println("yessir", bytesRead)
+// Serve accepts clients on l until it fails, it returns the error of accept.
+func Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
 		if err != nil {
-			return nil, totalBytesRead, err
+			return err
 		}
-		totalBytesRead += bytesRead
+		AcceptClient(c)
 	}
-	defer conn.SetReadDeadline(time.Time{})
-	return buffer, totalBytesRead, nil
 }
 
-// writeAll writes the given data to the provided connection until all bytes are written or an error occurs.
-// It sets a write deadline if a timeout is specified.
-// The function returns the total number of bytes written and any error encountered.
-func writeAll(connection *net.Conn, data []byte, timeout int) (int, error) {
-	totalBytesWritten := 0
-	conn := *connection
-
-	if timeout != 0 {
-		conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(timeout)))
+// AcceptClient starts serving connection of a new client unless it is banned or over connection limits.
+func AcceptClient(c net.Conn) {
+	if IsAddrBanned(c.RemoteAddr()) {
+		Log.Info("rejected banned client", F(logKeyRemote, c.RemoteAddr().String()))
+		c.Close()
+		return
 	}
-
-	for totalBytesWritten < len(data) {
-		bytesWritten, err := conn.Write(data[totalBytesWritten:])
-		if err != nil {
-			return bytesWritten, err
-		}
-		totalBytesWritten += bytesWritten
+	transport := NewConnTransport(c)
+	if err := AdmitConnection(transport); err != nil {
+		Log.Info("rejected client", F(logKeyRemote, c.RemoteAddr().String()), F(logKeyError, err))
+		RejectConnection(transport, err)
+		return
 	}
-	defer conn.SetWriteDeadline(time.Time{})
-	return totalBytesWritten, nil
+	id := int(atomic.AddInt64(&lastClientId, 1))
+	player := &Player{Conn: transport, ClientId: id, TimeSinceLastPing: Now()}
+	Log.Info("client connected", F(logKeyRemote, c.RemoteAddr().String()), F(logKeyClientId, id))
+	go ProcessClient(transport, player)
 }
 
 // ProcessClient handles the communication with a client.
@@ -71,83 +58,198 @@ func writeAll(connection *net.Conn, data []byte, timeout int) (int, error) {
 // the connection is closed.
 //
 // Parameters:
-// - connection: The network connection with the client.
+// - transport: The connection with the client (TCP, TLS, WebSocket or in-memory).
 // - player: A pointer to the Player struct representing the client.
 //
 // Note: This function should be called as a goroutine to handle multiple clients concurrently.
-func ProcessClient(connection net.Conn, player *Player) {
-	defer connection.Close()
+func ProcessClient(transport Transport, player *Player) {
+	defer transport.Close()
+	atomic.AddInt64(&metrics.connectedClients, 1)
+	defer atomic.AddInt64(&metrics.connectedClients, -1)
+	connLog := Log.With(F(logKeyRemote, transport.RemoteAddr().String()), F(logKeyClientId, player.ClientId))
 	invalidOp := 0
+	limiter := newConnLimiter()
+	authenticated := false
+	relayed := false //relayed by another instance, never handed off again
+	defer func() { releaseConnection(transport, authenticated) }()
+	transport.SetReadDeadline(time.Now().Add(time.Second * LoginTimeout))
 	for {
-		msg, _, err := readAll(&connection, MsgHeaderLen, 0)
-		if err != nil {
-			fmt.Println("could not read client message, closing", err)
-			return
+		frame, err := transport.ReadFrame()
+		if _, ok := err.(*frameError); ok {
+			connLog.Warn("invalid frame", F(logKeyOpcode, frame.Opcode), F(logKeyError, err))
+			stateMutex.Lock()
+			closeConn := recordInvalidOp(player, transport, &invalidOp, connLog)
+			stateMutex.Unlock()
+			if closeConn {
+				return
+			}
+			opcode := MsgErrOpcode
+			if knownOpcodes[frame.Opcode] {
+				opcode = frame.Opcode
+			}
+			sendMsg(transport, createOpCode(opcode, false, err.Error()+ArgSep+SrvErrInvalidFrame), 0)
+			continue
 		}
-
-		msgHeader := string(msg[0:len(MsgMagic)])
-		opcode := string(msg[len(MsgMagic) : len(MsgMagic)+len(MsgLoginOpcode)])
-		if msgHeader != MsgMagic {
-			fmt.Println("msg header was incorrect")
+		if isStreamError(err) {
+			connLog.Warn("invalid frame, closing", F(logKeyOpcode, frame.Opcode), F(logKeyError, err))
+			sendMsg(transport, createOpCode(MsgErrOpcode, false, err.Error()+ArgSep+SrvErrInvalidFrame), 1)
 			return
 		}
-
-		dataLen, err := strconv.Atoi(string(msg[len(MsgMagic)+len(MsgLoginOpcode):]))
-		if err != nil {
-			fmt.Println("couldnt get data length", string(msg))
-			continue
-		}
-
-		//wait for data
-		//fmt.Println("waiting for bytes:", dataLen, string(msg))
-		data, _, err := readAll(&connection, dataLen, 0)
 		if err != nil {
-			fmt.Println(err)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !authenticated {
+				connLog.Info("client did not log in in time, closing")
+				metrics.limitRejections.inc(SrvErrLoginTimeout)
+				sendMsg(transport, createOpCode(MsgErrOpcode, false, "login timeout"+ArgSep+SrvErrLoginTimeout), 1)
+				return
+			}
+			connLog.Info("could not read client message, closing", F(logKeyError, err))
 			return
 		}
+		opcode := frame.Opcode
+		metrics.messagesReceived.inc(getOpcodeLabel(opcode))
 
-		log.Println(fmt.Sprintf("Received from %s message: %s", connection.RemoteAddr().String(), string(msg)+string(data)))
+		if err := limiter.allow(opcode); err != nil {
+			connLog.Info("message dropped", F(logKeyOpcode, opcode), F(logKeyError, err))
+			metrics.limitRejections.inc(SrvErrRateLimited)
+			_, err = sendMsg(transport, createOpCode(opcode, false, err.Error()), 0)
+			if err != nil {
+				connLog.Warn("could not send message to client", F(logKeyError, err))
+				return
+			}
+			continue
+		}
 
-		if player.Conn == nil && opcode != MsgLoginOpcode && opcode != MsgPingOpcode {
-			_, err := sendMsg(&connection, createOpCode(opcode, false, "Only logged in clients can execute commands other than ping."), 0)
+		if opcode == nodeRelayOpcode && !authenticated && !relayed {
+			client, err := acceptRelayed(transport, frame)
 			if err != nil {
-				fmt.Println("could not send message to client")
+				connLog.Warn("relayed connection refused", F(logKeyError, err))
+				sendMsg(transport, createOpCode(opcode, false, err.Error()), 1)
 				return
 			}
-		} else {
-			opMessage, err := processOperation(&player, &connection, opcode, strings.Split(string(data), ArgSep))
-			messageToSend := opMessage
-			success := true //represenets status of operation
+			connLog = Log.With(F(logKeyRemote, client.RemoteAddr().String()), F("node", transport.RemoteAddr().String()),
+				F(logKeyClientId, player.ClientId))
+			connLog.Info("relayed connection accepted")
+			transport = client
+			relayed = true
+			stateMutex.Lock()
+			player.Conn = transport
+			stateMutex.Unlock()
+			sendMsg(transport, createOpCode(opcode, true, ""), 0)
+			continue
+		}
+		if opcode == MsgLoginOpcode && !authenticated && !relayed {
+			owner, err := connectSessionOwner(player, frame)
 			if err != nil {
-				fmt.Println("could not process operation", err)
-				messageToSend = err.Error()
-				success = false
-			} else if opcode == MsgLoginOpcode {
-				messageToSend = opMessage + ArgSep + fmt.Sprint(defaultBoardSize) //send board size
+				sendMsg(transport, createOpCode(opcode, false, err.Error()), 1)
+				return
 			}
-
-			if !(opMessage == "" && err == nil) { //if string is empty and err is nil means "dont send response" (its handled in processOperation)
-				messageToSend = createOpCode(opcode, success, messageToSend)
-				msgArg := strings.Split(messageToSend, ArgSep)
-				msgLastArg := msgArg[len(msgArg)-1]
-				if msgLastArg == SrvErrInvalidOp {
-					invalidOp++
-					if invalidOp >= MaxInvalidOp {
-						log.Printf(fmt.Sprintf("Client %s sent too many invalid operations (%d), closing connection\n", connection.RemoteAddr().String(), invalidOp))
-						playerDisconnected(player)
-						return
-					}
-				}
-				_, err = sendMsg(&connection, messageToSend, 0)
-				//log.Default().Println("Sent to:", connection.RemoteAddr().String(), messageToSend)
-				if err != nil {
-					fmt.Println("could not send message to client")
-					//return
-				}
+			if owner != nil {
+				authenticated = true
+				connAuthenticated()
+				transport.SetReadDeadline(time.Time{})
+				handOffClient(transport, owner)
+				return
+			}
+		}
+		if opcode == MsgJoinOpcode && authenticated && !relayed {
+			if owner := connectGameOwner(player, frame); owner != nil {
+				handOffClient(transport, owner)
+				return
 			}
 		}
-		//fmt.Printf("%v\n", player)
+
+		stateMutex.Lock()
+		closeConn := handleFrame(&player, transport, frame, &invalidOp, connLog)
+		loggedIn := player.Id != 0
+		stateMutex.Unlock()
+		if !authenticated && loggedIn {
+			authenticated = true
+			connAuthenticated()
+			transport.SetReadDeadline(time.Time{})
+		}
+		if closeConn {
+			return
+		}
+	}
+}
+
+// handleFrame processes one message of the client and sends the response.
+// It returns true if the connection should be closed. Caller must hold stateMutex.
+func handleFrame(playerAddress **Player, transport Transport, frame Frame, invalidOp *int, connLog *Logger) bool {
+	player := *playerAddress
+	opcode := frame.Opcode
+	data := frame.Data
+	msgLog := connLog.With(F(logKeyPlayerId, player.Id), F(logKeyOpcode, opcode))
+	msgLog.Debug("received message", F(logKeyPayload, redactPayload(opcode, string(data))))
+
+	if player.Conn == nil && opcode != MsgLoginOpcode && opcode != MsgPingOpcode {
+		_, err := sendMsg(transport, createOpCode(opcode, false, "Only logged in clients can execute commands other than ping."), 0)
+		if err != nil {
+			msgLog.Warn("could not send message to client", F(logKeyError, err))
+			return true
+		}
+		return false
+	}
+
+	opStart := time.Now()
+	args, err := parseArgs(data)
+	opMessage := ""
+	if err == nil {
+		opMessage, err = processOperation(playerAddress, transport, opcode, args)
 	}
+	metrics.operationDuration.observe(getOpcodeLabel(opcode), time.Since(opStart))
+	player = *playerAddress
+	messageToSend := opMessage
+	success := true //represenets status of operation
+	if err != nil {
+		msgLog.Info("could not process operation", F(logKeyError, err))
+		messageToSend = err.Error()
+		success = false
+	} else if opcode == MsgLoginOpcode {
+		messageToSend = opMessage + ArgSep + fmt.Sprint(defaultBoardSize) //send board size
+	}
+
+	if opMessage == "" && err == nil { //if string is empty and err is nil means "dont send response" (its handled in processOperation)
+		return false
+	}
+	messageToSend = createOpCode(opcode, success, messageToSend)
+	msgArg := strings.Split(messageToSend, ArgSep)
+	msgLastArg := msgArg[len(msgArg)-1]
+	if msgLastArg == SrvErrInvalidOp && recordInvalidOp(player, transport, invalidOp, msgLog) {
+		return true
+	}
+	_, err = sendMsg(transport, messageToSend, 0)
+	if err != nil {
+		msgLog.Warn("could not send message to client", F(logKeyError, err))
+		//return
+	}
+	if msgLastArg == SrvErrIncompatibleVersion {
+		msgLog.Info("client protocol version is not supported, closing connection")
+		return true
+	}
+	return false
+}
+
+// recordInvalidOp counts invalid operation of the client. It returns true if the client sent too many of them
+// and was disconnected, the connection should be closed. Caller must hold stateMutex.
+func recordInvalidOp(player *Player, transport Transport, invalidOp *int, msgLog *Logger) bool {
+	*invalidOp++
+	if *invalidOp < MaxInvalidOp {
+		return false
+	}
+	msgLog.Warn("client sent too many invalid operations, closing connection", F("invalid_ops", *invalidOp))
+	atomic.AddUint64(&metrics.invalidOpKicks, 1)
+	if ip := getAddrIP(transport.RemoteAddr()); ip != nil {
+		banned, err := bans.RecordInvalidOpKick(ip)
+		if err != nil {
+			msgLog.Error("could not save ban list", F(logKeyError, err))
+		}
+		if banned {
+			msgLog.Warn("ip temporarily banned after repeated invalid operation kicks", F("ip", ip.String()), F("seconds", AutoBanSeconds))
+		}
+	}
+	playerDisconnected(player)
+	return true
 }
 
 // removeGame removes a game from the available games list based on the given gameId.
@@ -157,51 +259,60 @@ func removeGame(gameId int) {
 	gameListMutex.Lock()
 	defer gameListMutex.Unlock()
 	if gameId < 0 {
-		log.Println("Game doesn't exist")
+		Log.Warn("game doesn't exist")
 		return
 	}
+	game := availableGamesList[gameId]
+	for _, id := range game.getJoinedIds() {
+		if gamesByPlayer[id] == game {
+			delete(gamesByPlayer, id)
+		}
+	}
 	availableGamesList = append(availableGamesList[:gameId], availableGamesList[gameId+1:]...)
 }
 
 // playerDisconnected handles the disconnection of a player.
 //
-// It logs out the player, finds the game the player was in, and performs necessary actions based on the game state and the other player's status.
-// If the other player is ready for a game and the game is over, it sends a message to return to lobby (where the player can find another player to play with).
-// If the other player is in a game and the game is not over, it sends a message to the other player indicating that the opponent has disconnected.
-// It also sends a message to the other player indicating that the opponent has lost connection.
+// It logs out the player, finds the game the player was in, and performs necessary actions based on the game state and the other players' status.
+// If other player is ready for a game and the game is over, it sends a message to return to lobby (where the player can find another player to play with).
+// If other player is in a game and the game is not over, it sends a message to the other player indicating that the opponent has disconnected,
+// the remaining players share the win.
+// It also sends a message to the other players indicating that the opponent has lost connection.
 //
 // Finally, it removes the player from the game and removes the game if necessary.
+// Caller must hold stateMutex.
 func playerDisconnected(player *Player) {
-	players.Logout(player)
+	playerLog(player).Info("player disconnected")
+	liveness.forget(player)
+	releaseSession(player.Name)
 	game := findGame(player)
-	if game != nil {
-		otherPlayer := game.GetOtherPlayer(player)
-		game.RemovePlayer(player)
-		if otherPlayer.Id != 0 {
-			if otherPlayer.Status == ReadyForGame && game.gameState == GameOver {
-				otherPlayer.Status = InLobby
-				_, err := sendMsg(otherPlayer.Conn, createOpCode(MsgPlayAgainOpcode, false, ClientMsgGameGone), 0)
-				if err != nil {
-					log.Println("could not send return to start to player two")
-				}
-			} else if otherPlayer.Status == InGame && game.gameState != GameOver {
-				_, err := sendMsg(otherPlayer.Conn, createOpCode(MsgGameOverOpcode, true, otherPlayer.Name+"(Opponent disconnected)"), 0)
-				if err != nil {
-					log.Println("could not send game over to player two")
-				}
-			}
-			_, err := sendMsg(otherPlayer.Conn, createOpCode(MsgStatusOpcode, true, "Opponent has lost connection."), 0)
+	if game == nil {
+		players.Logout(player)
+		return
+	}
+	otherPlayers := game.GetOtherPlayers(player)
+	endGameWithout(game, []*Player{player}, EndReasonDisconnect)
+	players.Logout(player) //before removing from the game, both zero the player and logout needs its id
+	game.RemovePlayer(player)
+	for _, otherPlayer := range otherPlayers {
+		if otherPlayer.Status == ReadyForGame && game.GetState() == GameOver {
+			otherPlayer.Status = InLobby
+			_, err := sendMsg(otherPlayer.Conn, createOpCode(MsgPlayAgainOpcode, false, ClientMsgGameGone), 0)
 			if err != nil {
-				log.Println("could not send status to other player")
+				playerLog(otherPlayer).Warn("could not send return to start to other player", F(logKeyError, err))
 			}
 		}
-		removeGame(getGameId(game))
+		_, err := sendMsg(otherPlayer.Conn, createOpCode(MsgStatusOpcode, true, "Opponent has lost connection."), 0)
+		if err != nil {
+			playerLog(otherPlayer).Warn("could not send status to other player", F(logKeyError, err))
+		}
 	}
+	removeGame(getGameId(game))
 }
 
 // broadcastMsg sends the given message to all connections in the given slice.
-func broadcastMsg(connections []*net.Conn, msg string, timeout int) []error {
-	log.Println(fmt.Sprintf("Broadcasting message to %d clients: %s", len(connections), msg))
+func broadcastMsg(connections []Transport, msg string, timeout int) []error {
+	Log.Debug("broadcasting message", F("clients", len(connections)))
 	errs := make([]error, 0)
 	for _, conn := range connections {
 		_, err := sendMsg(conn, msg, timeout)
@@ -216,10 +327,27 @@ func broadcastMsg(connections []*net.Conn, msg string, timeout int) []error {
 }
 
 // sendMsg sends the given message to the given connection.
-func sendMsg(connection *net.Conn, msg string, timeout int) (int, error) {
-	bytesWritten, err := writeAll(connection, []byte(msg), timeout)
-	log.Println(fmt.Sprintf("Sent to %s message: %s", (*connection).RemoteAddr().String(), msg))
-	return bytesWritten, err
+// If a timeout is specified, it sets a write deadline on the connection, the deadline is cleared before returning.
+// Client connections queue the message and their writer applies its own write timeout instead.
+func sendMsg(connection Transport, msg string, timeout int) (int, error) {
+	if connection == nil {
+		return 0, errNoTransport
+	}
+	frame, err := decodeFrame([]byte(msg))
+	if err != nil {
+		return 0, err
+	}
+	if timeout != 0 {
+		connection.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(timeout)))
+		defer connection.SetWriteDeadline(time.Time{})
+	}
+	err = connection.WriteFrame(frame)
+	metrics.messagesSent.inc(getOpcodeLabel(frame.Opcode))
+	Log.Debug("sent message", F(logKeyRemote, connection.RemoteAddr().String()), F(logKeyOpcode, frame.Opcode), F(logKeyPayload, string(frame.Data)))
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
 }
 
 // createOpCode creates an protocol response with the given parameters.
@@ -237,7 +365,8 @@ func createOpCode(opcode string, success bool, data string) string {
 // Handles recovery of player state in client.
 // If an error occurs during the operation, it returns an error message.
 // Otherwise, it returns a success message or an empty string.
-func processOperation(playerAddress **Player, conn *net.Conn, opcode string, data []string) (string, error) {
+// Caller must hold stateMutex.
+func processOperation(playerAddress **Player, conn Transport, opcode string, data []string) (string, error) {
 	player := *playerAddress
 	var err error = nil
 	var game *TicTacToeGame
@@ -249,9 +378,8 @@ func processOperation(playerAddress **Player, conn *net.Conn, opcode string, dat
 		if !player.Connected && opcode != MsgRecoveryOpcode {
 			return "", fmt.Errorf("must send recovery opcode after reconnection")
 		}
-		if game != nil && player.Connected && opcode != MsgPingOpcode {
-			otherPlayer := game.GetOtherPlayer(player)
-			if !otherPlayer.Connected && otherPlayer.Id != 0 {
+		if game != nil && player.Connected && opcode != MsgPingOpcode && opcode != MsgHeartbeatOpcode && opcode != MsgClaimOpcode && game.GetState() != GameOver {
+			if isOtherPlayerDisconnected(game, player) {
 				informPlayerAboutDisconnect(player)
 				return "", fmt.Errorf("other player disconnected, must wait for other player") //s
 			}
@@ -261,17 +389,18 @@ func processOperation(playerAddress **Player, conn *net.Conn, opcode string, dat
 	switch opcode {
 	case MsgLoginOpcode:
 		relogin := false
-		if len(data) != 1 {
-			return "", fmt.Errorf("wrong number of arguments")
+		name, err := parseLoginArgs(data)
+		if err != nil {
+			return "", err
 		}
-		if len(data[0]) == 0 {
-			return "", fmt.Errorf("name cannot be empty")
+		if bans.IsNameBanned(name) {
+			return "", fmt.Errorf("name is banned")
 		}
-		loginPlayer, err := players.Login(conn, data[0], player) //if no err -> replace old player with new one
+		loginPlayer, err := players.Login(conn, name, player) //if no err -> replace old player with new one
 		if err != nil {
 			//didnt find player
 			//add
-			player.Name = data[0]
+			player.Name = name
 			err := players.AddNewPlayer(player)
 			if err != nil {
 				return "", fmt.Errorf(err.Error())
@@ -281,114 +410,88 @@ func processOperation(playerAddress **Player, conn *net.Conn, opcode string, dat
 			player = *playerAddress
 			relogin = true
 		}
+		claimSession(player)
 
-		updatePlayerConnected(player)
 		if relogin {
-			player.Connected = false //go call recovery msg
-			return "", fmt.Errorf(ClientMsgRecoveryLogin + ArgSep + fmt.Sprint(defaultBoardSize))
+			playerLostConnection(player) //go call recovery msg
+			liveness.ping(player)
+			boardSize := defaultBoardSize
+			if game := findGame(player); game != nil {
+				boardSize = game.GetBoardSize()
+			}
+			return "", fmt.Errorf(ClientMsgRecoveryLogin + ArgSep + fmt.Sprint(boardSize))
 		} else {
-			go disconnectHandler(player)
-			go ConnectionCloseHandler(player)
+			liveness.watch(player)
+			playerLog(player).Info("player logged in", F("name", player.Name))
 			return fmt.Sprintf("Welcome %s. Your ID is: %d", player.Name, player.Id), nil
 		}
 	case MsgJoinOpcode:
 		if player.Status != InLobby {
 			return "", fmt.Errorf("player not in lobby" + ArgSep + SrvErrInvalidOp)
 		}
-		game := operationJoin(player)
-
-		err = game.Start()
+		gameType, rules, err := parseJoinArgs(data)
 		if err != nil {
-			log.Println(err.Error())
-			player.Status = ReadyForGame
-			return fmt.Sprintf("joined game %d", getGameId(game)), nil
-		}
-		otherPlayer := game.GetOtherPlayer(player)
-		//broadcast game started
-		_, err := sendMsg(player.Conn, createOpCode(MsgGameStartedOpcode, true, otherPlayer.Name), 0)
-		if err != nil {
-			log.Println("could not send game started to player one")
-		}
-		_, err = sendMsg(otherPlayer.Conn, createOpCode(MsgGameStartedOpcode, true, player.Name), 0)
-		if err != nil {
-			log.Println("could not send game started to player two")
+			return "", err
 		}
+		game := operationJoin(player, gameType, rules)
 
-		game.players[0].Status = InGame
-		game.players[1].Status = InGame
-		//tell player one to move
-		_, err = sendMsg(game.players[0].Conn, createOpCode(MsgYourTurnOpcode, true, ""), 0)
+		err = game.Start()
 		if err != nil {
-			log.Println("could not send move to player one")
+			playerLog(player).Debug("game not started", F(logKeyError, err))
+			player.Status = ReadyForGame
+			return fmt.Sprintf("joined game %d", game.GetId()), nil
 		}
+		announceGameStarted(game)
 		return "", nil
 
 	case MsgMoveOpcode:
-		if len(data) != 2 {
-			return "", fmt.Errorf("wrong number of arguments" + ArgSep + SrvErrInvalidOp)
+		x, y, symbol, err := parseMoveArgs(data)
+		if err != nil {
+			return "", err
 		}
 		if game == nil || player.Status != InGame {
 			return "", fmt.Errorf("player not in game" + ArgSep + SrvErrInvalidOp)
 		}
-		if game.gameState != WaitingForPlayerOneMove && game.gameState != WaitingForPlayerTwoMove {
+		if game.GetState() != WaitingForMove {
 			return "", fmt.Errorf("game not in play state" + ArgSep + SrvErrInvalidOp)
 		}
-		otherPlayer := game.GetOtherPlayer(player)
-		if !otherPlayer.Connected && otherPlayer.Id != 0 {
+		if isOtherPlayerDisconnected(game, player) {
 			informPlayerAboutDisconnect(player)
 			return "", fmt.Errorf("move: other player disconnected, must wait for other player")
 		}
 
-		x, err := strconv.Atoi(data[0])
-		if err != nil {
-			return "", fmt.Errorf("couldnt parse arg" + ArgSep + SrvErrInvalidOp)
-		}
-		y, err := strconv.Atoi(data[1])
-		if err != nil {
-			return "", fmt.Errorf("couldnt parse arg" + ArgSep + SrvErrInvalidOp)
-		}
 		if game == nil {
 			return "", fmt.Errorf("player not in game" + ArgSep + SrvErrInvalidOp)
 		}
-		err = game.Move(*player, x, y)
+		err = game.Move(*player, x, y, symbol)
 		if err != nil {
 			return "", fmt.Errorf(err.Error() + ArgSep + SrvErrInvalidOp)
 		}
 
 		//broadcast board in string format
 		board := game.GetBoardInParsableFormat()
-		errs := broadcastMsg([]*net.Conn{game.players[0].Conn, game.players[1].Conn}, createOpCode(MsgMoveOpcode, true, board), 0)
+		errs := broadcastMsg(getGameConnections(game), createOpCode(MsgMoveOpcode, true, board), 0)
 		if errs != nil {
-			log.Println("could not broadcast board to all players")
+			playerLog(player).Warn("could not broadcast board to all players", F(logKeyError, errs[0]))
 		}
 
-		if game.gameOverState != NotOver {
+		if game.GetGameOverState() != NotOver {
 			//game is over
-			result := ""
-			winner := game.GetGameWinner()
-			if winner == nil {
-				result = "Draw"
-			} else {
-				result = winner.Name
-			}
-			errs := broadcastMsg([]*net.Conn{game.players[0].Conn, game.players[1].Conn}, createOpCode(MsgGameOverOpcode, true, result), 0)
+			recordGameEnd(game)
+			errs := broadcastMsg(getGameConnections(game), createOpCode(MsgGameOverOpcode, true, game.GetGameResult()), 0)
 			if errs != nil {
-				log.Println("could not broadcast game over to all players")
+				playerLog(player).Warn("could not broadcast game over to all players", F(logKeyError, errs[0]))
 			}
 			//game.Reset(true)
 			return "", nil
 		}
 
-		//tell other player to move
-		if game.gameState == WaitingForPlayerOneMove {
-			_, err = sendMsg(game.players[0].Conn, createOpCode(MsgYourTurnOpcode, true, ""), 0)
-			if err != nil {
-				log.Println("could not send move to player two")
-			}
-		} else if game.gameState == WaitingForPlayerTwoMove {
-			_, err = sendMsg(game.players[1].Conn, createOpCode(MsgYourTurnOpcode, true, ""), 0)
+		//tell next player to move
+		nextPlayer := game.GetPlayerOnTurn()
+		if nextPlayer != nil {
+			_, err = sendMsg(nextPlayer.Conn, createOpCode(MsgYourTurnOpcode, true, ""), 0)
 			if err != nil {
-				log.Println("could not send move to player one")
+				playerLog(nextPlayer).Warn("could not send move to next player", F(logKeyError, err))
 			}
 		}
 		return "", nil
@@ -398,7 +501,7 @@ func processOperation(playerAddress **Player, conn *net.Conn, opcode string, dat
 			player.Status = InLobby
 			return "", fmt.Errorf(ClientMsgGameGone)
 		}
-		if !(player.Status == InGame && game.gameState == GameOver) {
+		if !(player.Status == InGame && game.GetState() == GameOver) {
 			return "", fmt.Errorf("player not in game or game not over" + ArgSep + SrvErrInvalidOp)
 		}
 
@@ -410,59 +513,53 @@ func processOperation(playerAddress **Player, conn *net.Conn, opcode string, dat
 
 		err = game.Start()
 		if err != nil {
-			log.Println(err.Error())
-			return fmt.Sprintf("requesting play again (game id: %d)", getGameId(game)), nil
+			playerLog(player).Debug("game not started", F(logKeyError, err))
+			return fmt.Sprintf("requesting play again (game id: %d)", game.GetId()), nil
 		}
 
-		otherPlayer := game.GetOtherPlayer(player)
-		//send game started with opponent name
-		_, err := sendMsg(player.Conn, createOpCode(MsgGameStartedOpcode, true, otherPlayer.Name), 0)
-		if err != nil {
-			log.Println("could not send game started to player one")
-		}
-		_, err = sendMsg(otherPlayer.Conn, createOpCode(MsgGameStartedOpcode, true, player.Name), 0)
-		if err != nil {
-			log.Println("could not send game started to player two")
-		}
-		game.players[0].Status = InGame
-		game.players[1].Status = InGame
-
-		//change starting player
-		if game.gameState == WaitingForPlayerOneMove {
-			game.gameState = WaitingForPlayerTwoMove
-		} else {
-			game.gameState = WaitingForPlayerOneMove
-		}
-		//tell player two to move
-		_, err = sendMsg(game.players[1].Conn, createOpCode(MsgYourTurnOpcode, true, ""), 0)
-		if err != nil {
-			log.Println("could not send move to player two")
-		}
+		//starting player changes with every game (see Start)
+		announceGameStarted(game)
 		return "", nil
 	case MsgReturnToStartOpcode:
 		if game == nil {
 			player.Status = InLobby
 			return "", fmt.Errorf(ClientMsgGameGone)
 		}
-		if !(player.Status == InGame && game.gameState == GameOver) {
+		if !(player.Status == InGame && game.GetState() == GameOver) {
 			return "", fmt.Errorf("player not in game or game not over" + ArgSep + SrvErrInvalidOp)
 		}
 		player.Status = InLobby
-		otherPlayer := game.GetOtherPlayer(player)
-
-		if otherPlayer.Status == ReadyForGame {
-			otherPlayer.Status = InLobby
-			_, err = sendMsg(otherPlayer.Conn, createOpCode(MsgPlayAgainOpcode, false, ClientMsgGameGone), 0)
-			if err != nil {
-				log.Println("could not send return to start to player two")
+		for _, otherPlayer := range game.GetOtherPlayers(player) {
+			if otherPlayer.Status == ReadyForGame {
+				otherPlayer.Status = InLobby
+				_, err = sendMsg(otherPlayer.Conn, createOpCode(MsgPlayAgainOpcode, false, ClientMsgGameGone), 0)
+				if err != nil {
+					playerLog(otherPlayer).Warn("could not send return to start to other player", F(logKeyError, err))
+				}
 			}
 		}
 		game.Reset(false)
 		removeGame(getGameId(game)) //player left, removing game
 		return "left the lobby", nil
+	case MsgHelloOpcode:
+		if player.Id != 0 {
+			return "", fmt.Errorf("hello must be sent before login" + ArgSep + SrvErrInvalidOp)
+		}
+		version, capabilities, err := negotiateProtocol(data)
+		if err != nil {
+			return "", err
+		}
+		player.Protocol = version
+		player.Capabilities = capabilities
+		return fmt.Sprint(version) + ArgSep + getCapabilityList(capabilities), nil
 	case MsgPingOpcode:
-		player.TimeSinceLastPing = time.Now()
+		player.TimeSinceLastPing = Now()
+		liveness.ping(player)
 		return "ping", nil
+	case MsgHeartbeatOpcode:
+		return "", handleHeartbeatEcho(player, data)
+	case MsgClaimOpcode:
+		return handleClaimOpcode(player, game)
 	case MsgRecoveryOpcode:
 		return handleRecoveryOpcode(player, game)
 	default:
@@ -473,6 +570,7 @@ func processOperation(playerAddress **Player, conn *net.Conn, opcode string, dat
 // handleRecoveryOpcode handles the recovery operation code for a player in a TicTacToe game.
 // It takes a player pointer and a game pointer as parameters and returns a string and an error.
 // The string represents the recovery option for the player, while the error indicates any error that occurred during the operation.
+// Caller must hold stateMutex.
 func handleRecoveryOpcode(player *Player, game *TicTacToeGame) (string, error) {
 	option := ""
 	var err error
@@ -482,126 +580,65 @@ func handleRecoveryOpcode(player *Player, game *TicTacToeGame) (string, error) {
 	} else if player.Status == ReadyForGame {
 		option = ClientMsgRecovery_ReadyForGame
 	} else if player.Status == InGame {
-		result := ""
-		winner := game.GetGameWinner()
-		if winner == nil {
-			result = "Draw"
-		} else {
-			result = winner.Name
-		}
-		otherPlayer := game.GetOtherPlayer(player)
-		otherPlayerName := ""
-		if otherPlayer.Id != 0 {
-			otherPlayerName = otherPlayer.Name
-		}
+		otherPlayerName := getOtherPlayerNames(game, player)
 		board := game.GetBoardInParsableFormat()
-		if game.gameState == WaitingForPlayerOneMove && player.Id == game.players[0].Id {
+		onTurn := game.GetPlayerOnTurn()
+		if onTurn != nil && onTurn.Id == player.Id {
 			option = ClientMsgRecovery_InGame_YourTurn + ArgSep + board + ArgSep + otherPlayerName
-		} else if game.gameState == WaitingForPlayerOneMove && player.Id == game.players[1].Id {
+		} else if onTurn != nil {
 			option = ClientMsgRecovery_InGame_OtherTurn + ArgSep + board + ArgSep + otherPlayerName
-		} else if game.gameState == WaitingForPlayerTwoMove && player.Id == game.players[1].Id {
-			option = ClientMsgRecovery_InGame_YourTurn + ArgSep + board + ArgSep + otherPlayerName
-		} else if game.gameState == WaitingForPlayerTwoMove && player.Id == game.players[0].Id {
-			option = ClientMsgRecovery_InGame_OtherTurn + ArgSep + board + ArgSep + otherPlayerName
-		} else if game.gameState == GameOver {
-			option = ClientMsgRecovery_InGame_GameOver + ArgSep + board + ArgSep + result + ArgSep + otherPlayerName
+		} else if game.GetState() == GameOver {
+			option = ClientMsgRecovery_InGame_GameOver + ArgSep + board + ArgSep + game.GetGameResult() + ArgSep + otherPlayerName
 		}
 	} else {
 		return "", fmt.Errorf("unknown player state")
 	}
 	if !player.Connected {
 		player.Connected = true
+		atomic.AddUint64(&metrics.recoveryHandshakes, 1)
 		if game != nil {
-			otherPlayer := game.GetOtherPlayer(player)
-			if otherPlayer.Id != 0 {
+			for _, otherPlayer := range game.GetOtherPlayers(player) {
 				_, err = sendMsg(otherPlayer.Conn, createOpCode(MsgContinueOpcode, true, ""), 0)
 				if err != nil {
-					log.Println("could not send continue to other player")
+					playerLog(otherPlayer).Warn("could not send continue to other player", F(logKeyError, err))
 				}
 			}
 		}
-		go disconnectHandler(player)
 	}
-	player.TimeSinceLastPing = time.Now()
+	player.TimeSinceLastPing = Now()
+	liveness.ping(player)
 	return option, nil
 }
 
 // informPlayerAboutDisconnect sends a message to the given player indicating that the opponent has disconnected.
+// Caller must hold stateMutex.
 func informPlayerAboutDisconnect(player *Player) {
 	game := findGame(player)
 	if game == nil {
 		return
 	}
-	otherPlayer := game.GetOtherPlayer(player)
-	if otherPlayer.Id == 0 {
+	if len(game.GetOtherPlayers(player)) == 0 {
 		return
 	}
 	_, err := sendMsg(player.Conn, createOpCode(MsgPauseOpcode, true, ""), 0)
 	if err != nil {
-		fmt.Println("could not send message to client")
+		playerLog(player).Warn("could not send pause to client", F(logKeyError, err))
 		return
 	}
 }
 
-// ConnectionCloseHandler handles the closing of a connection.
-// Always one per player.
-// Closes connection and removes the player has not pinged in a while (timeouted).
-func ConnectionCloseHandler(player *Player) {
-	log.Println("!!! Starting connection close handler for player " + player.Name + "!!!")
-	for {
-		time.Sleep(time.Second * PingTime)
-		if player.getTimeSinceLastPing() > time.Second*MaxSecondsBeforeDisconnect {
-			log.Println(fmt.Sprintf("Player %s (ID: %d) timed out, closing connection", player.Name, player.Id))
-
-			playerDisconnected(player)
-			if player.Conn == nil {
-				return
-			}
-			playerConn := (*player.Conn)
-			if playerConn != nil {
-				err := playerConn.Close()
-				if err != nil {
-					log.Println("could not close connection")
-				}
-			}
-			return
-		}
-	}
+// getPingTime returns expected time between pings
+func getPingTime() time.Duration {
+	return time.Second * time.Duration(atomic.LoadInt64(&pingTime))
 }
 
-// Checks if player has disconnected
-func disconnectHandler(player *Player) {
-	playerCopy := *player
-	for {
-		time.Sleep(time.Second * PingTime)
-		updatePlayerConnected(player)
-		if !player.Connected || playerCopy.Conn != player.Conn {
-			log.Printf("Player %s (ID: %d) disconnected\n", player.Name, player.Id)
-			game := findGame(player)
-			if game == nil {
-				return
-			}
-			otherPlayer := game.GetOtherPlayer(player)
-			if otherPlayer.Id == 0 {
-				return
-			}
-			informPlayerAboutDisconnect(otherPlayer)
-			return
-		}
-	}
-}
-
-// Sets player.Connected value based on PingTime and MaxNoPingReceived
-func updatePlayerConnected(player *Player) {
-	if player.Conn != nil {
-		if player.getTimeSinceLastPing() > time.Second*PingTime*MaxNoPingReceived {
-			player.Connected = false
-		} else {
-			player.Connected = true
-		}
-	} else {
-		player.Connected = false
+// setPingTime changes expected time between pings, missed pings must still fit before MaxSecondsBeforeDisconnect
+func setPingTime(seconds int) error {
+	if seconds < 1 || seconds*MaxNoPingReceived >= MaxSecondsBeforeDisconnect {
+		return fmt.Errorf("ping time must be between 1 and %d seconds", (MaxSecondsBeforeDisconnect-1)/MaxNoPingReceived)
 	}
+	atomic.StoreInt64(&pingTime, int64(seconds))
+	return nil
 }
 
 // Get game id in list of available games
@@ -616,39 +653,129 @@ func getGameId(game *TicTacToeGame) int {
 	return -1
 }
 
-// Finds game that player is in or joins existing game that is not full or creates new game if none found
-func operationJoin(player *Player) *TicTacToeGame {
+// Finds game that player is in or joins existing game of the given type and rules that is not full or creates new game if none found
+func operationJoin(player *Player, gameType int, rules Rules) *TicTacToeGame {
 	game := findGame(player)
 	if game == nil {
-		game = joinGame(player)
+		game = joinGame(player, gameType, rules)
 	}
 	if game == nil {
-		game = createGame()
-		game.Join(player)
+		game = createGame(gameType, rules)
+		gameListMutex.Lock()
+		if game.Join(player) == nil {
+			gamesByPlayer[player.Id] = game
+		}
+		gameListMutex.Unlock()
 	}
 	return game
 }
 
+// getGameStartedInfo returns game type and rules announced to players in game started message
+func getGameStartedInfo(game *TicTacToeGame) string {
+	return game.GetGameTypeName() + ArgSep + game.GetRules().String()
+}
+
+// announceGameStarted sends game started to all players of the game and tells the player on turn to move
+func announceGameStarted(game *TicTacToeGame) {
+	for _, v := range game.GetPlayers() {
+		v.Status = InGame
+		info := getOtherPlayerNames(game, v)
+		if v.HasCapability(CapRules) {
+			info += ArgSep + getGameStartedInfo(game)
+		}
+		_, err := sendMsg(v.Conn, createOpCode(MsgGameStartedOpcode, true, info), 0)
+		if err != nil {
+			playerLog(v).Warn("could not send game started to player", F(logKeyError, err))
+		}
+	}
+	onTurn := game.GetPlayerOnTurn()
+	if onTurn != nil {
+		_, err := sendMsg(onTurn.Conn, createOpCode(MsgYourTurnOpcode, true, ""), 0)
+		if err != nil {
+			playerLog(onTurn).Warn("could not send move to player", F(logKeyError, err))
+		}
+	}
+}
+
+// recordGameEnd counts the finished game in metrics and logs its result and reason.
+func recordGameEnd(game *TicTacToeGame) {
+	reason := game.GetEndReason()
+	result := resultWin
+	switch {
+	case game.GetGameOverState() == Draw:
+		result = resultDraw
+	case game.GetGameOverState() == Aborted:
+		result = resultAborted
+	case reason != EndReasonLine:
+		result = resultDisconnected
+	}
+	metrics.gamesFinished.inc(result)
+	Log.Info("game ended", F(logKeyGameId, game.GetId()), F("result", game.GetGameResult()), F("reason", reason))
+}
+
+// getOtherPlayerNames returns names of the other players in the game separated by ruleSep
+func getOtherPlayerNames(game *TicTacToeGame, player *Player) string {
+	names := make([]string, 0)
+	for _, v := range game.GetOtherPlayers(player) {
+		names = append(names, v.Name)
+	}
+	return strings.Join(names, ruleSep)
+}
+
+// getGameConnections returns connections of all players seated in the game
+func getGameConnections(game *TicTacToeGame) []Transport {
+	connections := make([]Transport, 0)
+	for _, v := range game.GetPlayers() {
+		if v.Id != 0 {
+			connections = append(connections, v.Conn)
+		}
+	}
+	return connections
+}
+
+// isOtherPlayerDisconnected returns true if any other player in the game has lost connection
+func isOtherPlayerDisconnected(game *TicTacToeGame, player *Player) bool {
+	for _, v := range game.GetOtherPlayers(player) {
+		if !v.Connected {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGameType converts game type name from join operation to game type constant, empty name means classic game
+func parseGameType(name string) (int, error) {
+	switch name {
+	case "", GameTypeClassic:
+		return ClassicGame, nil
+	case GameTypeUltimate:
+		return UltimateGame, nil
+	default:
+		return 0, fmt.Errorf("unknown game type")
+	}
+}
+
 // Find game that player is in
 func findGame(player *Player) *TicTacToeGame {
 	gameListMutex.Lock()
 	defer gameListMutex.Unlock()
-	for _, v := range availableGamesList {
-		if v.players[0].Id == player.Id || v.players[1].Id == player.Id {
-			return v
-		}
+	game := gamesByPlayer[player.Id]
+	if game == nil || !game.HasPlayer(player) {
+		//player not in any game
+		return nil
 	}
-	//player not in any game
-	return nil
+	return game
 }
 
-// Join game that is not full
-func joinGame(player *Player) *TicTacToeGame {
+// Join game of the given type and rules that is not full
+func joinGame(player *Player, gameType int, rules Rules) *TicTacToeGame {
 	gameListMutex.Lock()
 	defer gameListMutex.Unlock()
 	for i, v := range availableGamesList {
-		if v.players[0].Id == 0 || v.players[1].Id == 0 {
-			v.Join(player)
+		if v.gameType == gameType && v.GetRules() == rules && !v.IsFull() {
+			if v.Join(player) == nil {
+				gamesByPlayer[player.Id] = v
+			}
 			return availableGamesList[i]
 		}
 	}
@@ -656,11 +783,19 @@ func joinGame(player *Player) *TicTacToeGame {
 	return nil
 }
 
-// Create a new game
-func createGame() *TicTacToeGame {
-	newGame := NewTickTackToeGame(defaultBoardSize)
+// Create a new game of the given type and rules
+func createGame(gameType int, rules Rules) *TicTacToeGame {
+	var newGame *TicTacToeGame
+	if gameType == UltimateGame {
+		newGame = NewUltimateTicTacToeGame()
+	} else {
+		newGame = NewTickTackToeGame(rules.BoardSize, rules.Seats, rules.WinLength)
+	}
+	newGame.rules = rules
 	gameListMutex.Lock()
 	defer gameListMutex.Unlock()
+	newGame.id = nextGameId
+	nextGameId++
 	availableGamesList = append(availableGamesList, newGame)
 	return newGame
 }
@@ -0,0 +1,243 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Protocol flows of scripted clients, see harness_test.go.
+
+func TestLoginFlow(t *testing.T) {
+	defer kickTestPlayers("login1")
+	c := connectTestClient(t)
+	defer c.conn.Close()
+
+	c.send(MsgJoinOpcode)
+	c.expectData(MsgJoinOpcode, ClientMsgErr)
+	c.send(MsgLoginOpcode, "")
+	c.expectData(MsgLoginOpcode, ClientMsgErr+ArgSep+"name cannot be empty")
+	c.login("login1")
+	c.ping()
+	if players.GetPlayerByName("login1") == nil {
+		t.Error("player not logged in")
+	}
+}
+
+func TestGameFlow(t *testing.T) {
+	defer kickTestPlayers("flow1", "flow2")
+	first, second := startTestGame(t, [2]string{"flow1", "flow2"})
+	defer first.conn.Close()
+	defer second.conn.Close()
+
+	second.send(MsgMoveOpcode, "2", "2")
+	second.expectData(MsgMoveOpcode, ClientMsgErr)
+	first.move("0", "0")
+	second.expect(MsgYourTurnOpcode)
+	second.move("1", "0")
+	first.expect(MsgYourTurnOpcode)
+	first.send(MsgMoveOpcode, "1", "0")
+	first.expectData(MsgMoveOpcode, ClientMsgErr)
+	first.move("0", "1")
+	second.expect(MsgYourTurnOpcode)
+	second.move("1", "1")
+	first.expect(MsgYourTurnOpcode)
+	first.move("0", "2")
+	first.expectData(MsgGameOverOpcode, ClientMsgOk+ArgSep+"flow1")
+	second.expectData(MsgGameOverOpcode, ClientMsgOk+ArgSep+"flow1")
+
+	//play again, the other player starts
+	first.send(MsgPlayAgainOpcode)
+	first.expectData(MsgPlayAgainOpcode, ClientMsgOk+ArgSep+"requesting play again")
+	second.send(MsgPlayAgainOpcode)
+	first.expectData(MsgGameStartedOpcode, ClientMsgOk+ArgSep+"flow2")
+	second.expectData(MsgGameStartedOpcode, ClientMsgOk+ArgSep+"flow1")
+	second.expect(MsgYourTurnOpcode)
+	second.move("0", "0")
+	first.expect(MsgYourTurnOpcode)
+	first.move("1", "0")
+	second.expect(MsgYourTurnOpcode)
+	second.move("0", "1")
+	first.expect(MsgYourTurnOpcode)
+	first.move("1", "1")
+	second.expect(MsgYourTurnOpcode)
+	second.move("0", "2")
+	first.expectData(MsgGameOverOpcode, ClientMsgOk+ArgSep+"flow2")
+
+	//return to start, the player waiting to play again loses the game
+	first.send(MsgPlayAgainOpcode)
+	first.expectData(MsgPlayAgainOpcode, ClientMsgOk)
+	second.send(MsgReturnToStartOpcode)
+	second.expectData(MsgReturnToStartOpcode, ClientMsgOk+ArgSep+"left the lobby")
+	first.expectData(MsgPlayAgainOpcode, ClientMsgErr+ArgSep+ClientMsgGameGone)
+	first.send(MsgJoinOpcode)
+	first.expectData(MsgJoinOpcode, ClientMsgOk+ArgSep+"joined game")
+}
+
+func TestRecoveryFlow(t *testing.T) {
+	defer kickTestPlayers("reco1", "reco2")
+	first, second := startTestGame(t, [2]string{"reco1", "reco2"})
+	defer second.conn.Close()
+	first.move("1", "1")
+	second.expect(MsgYourTurnOpcode)
+
+	first.conn.Close()
+	first = connectTestClient(t)
+	defer first.conn.Close()
+	if response := first.login("reco1"); !strings.Contains(response, ClientMsgRecoveryLogin) {
+		t.Fatalf("relogin response %q, expected recovery", response)
+	}
+	second.expect(MsgPauseOpcode)
+	first.send(MsgRecoveryOpcode)
+	first.expectData(MsgRecoveryOpcode, ClientMsgOk+ArgSep+ClientMsgRecovery_InGame_OtherTurn)
+	second.expect(MsgContinueOpcode)
+	second.move("0", "0")
+	first.expect(MsgYourTurnOpcode)
+}
+
+func TestRecoveryLoginBoardSize(t *testing.T) {
+	defer kickTestPlayers("size1", "size2")
+	first, second := startTestGame(t, [2]string{"size1", "size2"}, GameTypeClassic, RuleSize+"5")
+	defer second.conn.Close()
+
+	first.conn.Close()
+	first = connectTestClient(t)
+	defer first.conn.Close()
+	if response := first.login("size1"); response != ClientMsgErr+ArgSep+ClientMsgRecoveryLogin+ArgSep+"5" {
+		t.Errorf("relogin response %q, expected recovery with size of the game board", response)
+	}
+}
+
+func TestDisconnectFlow(t *testing.T) {
+	defer kickTestPlayers("gone2")
+	first, second := startTestGame(t, [2]string{"gone1", "gone2"})
+	defer second.conn.Close()
+
+	//kicked player is disconnected the same way as a timed out player
+	if err := kickPlayer("gone1", "test"); err != nil {
+		t.Fatal(err)
+	}
+	first.expectClosed()
+	second.expectData(MsgGameOverOpcode, ClientMsgOk+ArgSep+"gone2")
+	second.expectData(MsgStatusOpcode, ClientMsgOk+ArgSep+"Opponent has lost connection.")
+	if players.GetPlayerByName("gone1") != nil {
+		t.Error("player not removed after disconnect")
+	}
+}
+
+func TestPingTimeoutFlow(t *testing.T) {
+	clock := useFakeClock(t)
+	defer kickTestPlayers("idle1", "idle2")
+	first, second := startTestGame(t, [2]string{"idle1", "idle2"})
+	defer first.conn.Close()
+	defer second.conn.Close()
+
+	//only the second player pings, the first misses pings and is paused, then disconnected,
+	//events are awaited before the next ping, ping waiting for its response skips other messages
+	elapsed := time.Duration(0)
+	step := getPingTime() + time.Second
+	for elapsed < getPingTime()*MaxNoPingReceived {
+		if elapsed > 0 {
+			second.ping()
+		}
+		advanceClock(t, clock, step)
+		elapsed += step
+	}
+	second.expect(MsgPauseOpcode)
+	if player := players.GetPlayerByName("idle1"); player == nil {
+		t.Fatal("player removed before disconnect timeout")
+	}
+	for elapsed < time.Second*MaxSecondsBeforeDisconnect {
+		second.ping()
+		advanceClock(t, clock, step)
+		elapsed += step
+	}
+	first.expectClosed()
+	second.expectData(MsgGameOverOpcode, ClientMsgOk+ArgSep+"idle2")
+	second.expectData(MsgStatusOpcode, ClientMsgOk+ArgSep+"Opponent has lost connection.")
+	if players.GetPlayerByName("idle1") != nil {
+		t.Error("player not removed after disconnect timeout")
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	c := connectTestClient(t)
+	defer c.conn.Close()
+	c.send(MsgLoginOpcode, "bad\x00name")
+	c.expectData(MsgLoginOpcode, ClientMsgErr+ArgSep+"arguments contain control characters"+ArgSep+SrvErrInvalidOp)
+
+	//length with sign cannot be trusted, the stream is not read further (writing the rest fails on the closed pipe)
+	c.conn.(*connTransport).conn.Write([]byte(MsgMagic + MsgLoginOpcode + "+005alice" + MsgMagic))
+	c.expectData(MsgErrOpcode, ClientMsgErr+ArgSep+errFrameLength.Error()+ArgSep+SrvErrInvalidFrame)
+	c.expectClosed()
+	if players.GetPlayerByName("alice") != nil {
+		t.Error("data after invalid header was read")
+	}
+}
+
+func TestInvalidJSONFrames(t *testing.T) {
+	c := connectTestClient(t)
+	defer c.conn.Close()
+	body := `{"op":`
+	for i := 1; i < MaxInvalidOp; i++ {
+		c.conn.(*connTransport).conn.Write([]byte(MsgMagicJSON + fmt.Sprintf("%04d", len(body)) + body))
+		if data := string(c.expect(MsgErrOpcode).Data); !strings.HasSuffix(data, ArgSep+SrvErrInvalidFrame) {
+			t.Errorf("response %q to invalid json message, expected %s", data, SrvErrInvalidFrame)
+		}
+	}
+	c.conn.(*connTransport).conn.Write([]byte(MsgMagicJSON + fmt.Sprintf("%04d", len(body)) + body))
+	c.expectClosed()
+}
+
+func TestUnauthConnLimit(t *testing.T) {
+	connections.mu.Lock()
+	waiting := connections.unauth
+	connections.mu.Unlock()
+	if err := ConfigureCapacity(MaxClients, MaxConns, MaxConns, waiting+1); err != nil {
+		t.Fatal(err)
+	}
+	defer ConfigureCapacity(MaxClients, MaxConns, MaxConnsPerIP, MaxUnauthConns)
+
+	first, _ := NewPipeTransport()
+	if err := AdmitConnection(first); err != nil {
+		t.Fatalf("connection under the limit rejected: %v", err)
+	}
+	defer releaseConnection(first, false)
+	second, _ := NewPipeTransport()
+	if err, ok := AdmitConnection(second).(*limitError); !ok || err.reason != SrvErrServerBusy {
+		t.Errorf("connection over the limit admitted or rejected with %v", err)
+	}
+}
+
+func TestFindGameIndex(t *testing.T) {
+	rules, err := parseRules(ClassicGame, []string{RuleMisere})
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := &Player{Id: 900001, Name: "indexed"}
+	game := operationJoin(player, ClassicGame, rules)
+	if found := findGame(player); found != game {
+		t.Fatalf("found game %v, expected joined game", found)
+	}
+	removeGame(getGameId(game))
+	if found := findGame(player); found != nil {
+		t.Errorf("found removed game %d", found.GetId())
+	}
+	gameListMutex.Lock()
+	defer gameListMutex.Unlock()
+	if _, ok := gamesByPlayer[player.Id]; ok {
+		t.Error("removed game still indexed by its player")
+	}
+}
+
+func TestOversizedFrame(t *testing.T) {
+	c := connectTestClient(t)
+	defer c.conn.Close()
+	c.conn.(*connTransport).conn.Write([]byte(MsgMagic + MsgLoginOpcode + fmt.Sprintf("%04d", MaxDataLen+1) + strings.Repeat("a", MaxDataLen+1)))
+	if data := string(c.expect(MsgLoginOpcode).Data); !strings.HasSuffix(data, ArgSep+SrvErrInvalidFrame) {
+		t.Errorf("response %q to oversized message, expected %s", data, SrvErrInvalidFrame)
+	}
+	//data of the oversized message was skipped, the next message is read
+	c.ping()
+}
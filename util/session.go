@@ -0,0 +1,392 @@
+package util
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Several server instances can run behind a TCP load balancer when they share a session store.
+// A player and its game are owned by the instance the player logged in on, the store records the owner by name.
+// When the player logs in on another instance (e.g. reconnects after a drop), that instance hands the connection
+// off to the owner: it replays the hello and login and relays frames in both directions, so the recovery handshake
+// and the rest of the game are handled by the owner.
+//
+// A relayed connection starts with a node message carrying the client address and the node secret (-node-secret).
+// The owner trusts it if the secret matches or the connection comes from a peer node (see cluster.go), and then
+// checks bans, counts connections per IP and logs with the client address instead of the address of the instance.
+//
+//	request:  nodeRelayOpcode with client address;secret
+//	response: nodeRelayOpcode with ok, or err with reason and the connection is closed
+
+const nodeRelayOpcode = "102"
+
+// how long the session file lock may be held before it is considered stale
+const sessionLockTimeout = 5 * time.Second
+
+var errSessionLock = errors.New("could not lock session file")
+
+// Session records which server instance owns logged in player.
+type Session struct {
+	Name    string    `json:"name"`
+	Node    string    `json:"node"` //address other instances forward clients of the player to
+	Created time.Time `json:"created"`
+}
+
+// SessionStore is a registry of sessions shared by server instances.
+type SessionStore interface {
+	Put(session Session) error
+	Get(name string) (Session, bool, error)
+	Delete(name string, node string) error //deletes the session only if it is owned by node
+}
+
+var sessions SessionStore = NewMemorySessionStore() //sessions of this instance and instances sharing the store
+var nodeAddr = ""                                   //address of this instance for other instances, empty if it runs alone
+var nodeSecret = ""                                 //secret authenticating connections relayed by other instances
+
+// ConfigureSessions sets session store shared with other instances, address this instance is reached at
+// and secret of relayed connections. It must be called before clients connect.
+func ConfigureSessions(store SessionStore, addr string, secret string) {
+	sessions = store
+	nodeAddr = addr
+	nodeSecret = secret
+}
+
+// memorySessionStore keeps sessions in memory, it is shared only by instances in one process.
+type memorySessionStore struct {
+	sessions map[string]Session
+	mu       sync.Mutex
+}
+
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *memorySessionStore) Put(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.Name] = session
+	return nil
+}
+
+func (s *memorySessionStore) Get(name string) (Session, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[name]
+	return session, ok, nil
+}
+
+func (s *memorySessionStore) Delete(name string, node string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[name]; ok && session.Node == node {
+		delete(s.sessions, name)
+	}
+	return nil
+}
+
+// fileSessionStore keeps sessions in a JSON file shared by instances on one host.
+// Changes are made under a lock file, so instances in different processes do not overwrite each other.
+type fileSessionStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileSessionStore(path string) SessionStore {
+	return &fileSessionStore{path: path}
+}
+
+func (s *fileSessionStore) Put(session Session) error {
+	return s.update(func(sessions map[string]Session) {
+		sessions[session.Name] = session
+	})
+}
+
+func (s *fileSessionStore) Get(name string) (Session, bool, error) {
+	sessions, err := s.load()
+	if err != nil {
+		return Session{}, false, err
+	}
+	session, ok := sessions[name]
+	return session, ok, nil
+}
+
+func (s *fileSessionStore) Delete(name string, node string) error {
+	return s.update(func(sessions map[string]Session) {
+		if session, ok := sessions[name]; ok && session.Node == node {
+			delete(sessions, name)
+		}
+	})
+}
+
+// update changes sessions in the file under the lock file.
+func (s *fileSessionStore) update(change func(map[string]Session)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(s.path + ".lock")
+	sessions, err := s.load()
+	if err != nil {
+		return err
+	}
+	change(sessions)
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	//write to temporary file first so readers never see half written file
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// lock creates the lock file, lock file older than sessionLockTimeout is left by a crashed instance and is removed.
+func (s *fileSessionStore) lock() error {
+	path := s.path + ".lock"
+	clock := getClock()
+	deadline := clock.Now().Add(sessionLockTimeout)
+	for clock.Now().Before(deadline) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(path); err == nil && clock.Now().Sub(info.ModTime()) > sessionLockTimeout {
+			os.Remove(path)
+			continue
+		}
+		<-clock.After(5 * time.Millisecond)
+	}
+	return errSessionLock
+}
+
+// load reads sessions from the file, missing file means no sessions.
+func (s *fileSessionStore) load() (map[string]Session, error) {
+	sessions := make(map[string]Session)
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// sessionUpdate is a change of the session store made by sessionWriter.
+type sessionUpdate struct {
+	store   SessionStore
+	session Session
+	release bool //delete the session if it is owned by session.Node instead of saving it
+}
+
+// sessionWriter applies session changes of logins and disconnects in order in its own goroutine,
+// so a slow store (e.g. contended session file) never blocks stateMutex.
+type sessionWriter struct {
+	pending []sessionUpdate
+	wake    chan struct{} //wakes the writer when changes are pending
+	start   sync.Once     //writer goroutine is started with the first change
+	mu      sync.Mutex
+}
+
+var sessionUpdates = &sessionWriter{wake: make(chan struct{}, 1)}
+
+// add queues session change, it never blocks.
+func (w *sessionWriter) add(update sessionUpdate) {
+	w.start.Do(func() { go w.run() })
+	w.mu.Lock()
+	w.pending = append(w.pending, update)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run applies queued changes.
+func (w *sessionWriter) run() {
+	for range w.wake {
+		w.mu.Lock()
+		updates := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+		for _, v := range updates {
+			if v.release {
+				if err := v.store.Delete(v.session.Name, v.session.Node); err != nil {
+					Log.Error("could not delete session", F("name", v.session.Name), F(logKeyError, err))
+				}
+			} else if err := v.store.Put(v.session); err != nil {
+				Log.Error("could not save session", F("name", v.session.Name), F(logKeyError, err))
+			}
+		}
+	}
+}
+
+// claimSession records that this instance owns the logged in player, the store is written in background.
+// Caller must hold stateMutex.
+func claimSession(player *Player) {
+	sessionUpdates.add(sessionUpdate{store: sessions, session: Session{Name: player.Name, Node: nodeAddr, Created: Now()}})
+}
+
+// releaseSession removes session of the player owned by this instance, the store is written in background.
+// Caller must hold stateMutex.
+func releaseSession(name string) {
+	sessionUpdates.add(sessionUpdate{store: sessions, session: Session{Name: name, Node: nodeAddr}, release: true})
+}
+
+// connectSessionOwner returns connection to the instance owning the player logging in, with the hello and login
+// replayed to it. It returns nil if the player is not owned by another instance. If the owner cannot be reached,
+// the session is taken over by this instance and the client is served locally. It returns error if the owner
+// refused the client.
+func connectSessionOwner(player *Player, login Frame) (Transport, error) {
+	if nodeAddr == "" {
+		return nil, nil
+	}
+	name := strings.Split(string(login.Data), ArgSep)[0]
+	if players.GetPlayerByName(name) != nil {
+		return nil, nil
+	}
+	session, ok, err := sessions.Get(name)
+	if err != nil {
+		Log.Error("could not read session", F("name", name), F(logKeyError, err))
+		return nil, nil
+	}
+	if !ok || session.Node == nodeAddr {
+		return nil, nil
+	}
+	stateMutex.Lock()
+	client := player.Conn.RemoteAddr()
+	version := player.Protocol
+	capabilities := getCapabilityList(player.Capabilities)
+	stateMutex.Unlock()
+	owner, err := dialNode(session.Node, client)
+	if _, refused := err.(*limitError); refused {
+		Log.Info("instance owning the player refused client", F("node", session.Node), F(logKeyError, err))
+		return nil, err
+	}
+	if err == nil && version != 0 {
+		_, err = requestNode(owner, Frame{Opcode: MsgHelloOpcode, Data: []byte(fmt.Sprint(version) + ArgSep + capabilities)})
+	}
+	if err == nil {
+		setNodeDeadline(owner, time.Time{})
+		err = owner.WriteFrame(login)
+	}
+	if err != nil {
+		Log.Warn("could not hand off client, taking over", F("node", session.Node), F(logKeyError, err))
+		if owner != nil {
+			owner.Close()
+		}
+		return nil, nil
+	}
+	return owner, nil
+}
+
+// dialNode connects to the game address of another instance and relays the client at client address on it.
+// It returns *limitError if the instance refused the client.
+func dialNode(addr string, client net.Addr) (Transport, error) {
+	conn, err := net.DialTimeout(ConnType, addr, time.Second*WriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	node := &connTransport{conn: conn, maxDataLen: maxFrameDataLen}
+	setNodeDeadline(node, time.Now().Add(time.Second*WriteTimeout))
+	response, err := requestNode(node, Frame{Opcode: nodeRelayOpcode, Data: []byte(client.String() + ArgSep + nodeSecret)})
+	if err == nil && !strings.HasPrefix(string(response.Data), ClientMsgOk) {
+		args := strings.Split(string(response.Data), ArgSep)
+		err = &limitError{msg: "refused by " + addr, reason: args[len(args)-1]}
+	}
+	if err != nil {
+		node.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+// relayedAddr is address of a client relayed by another instance.
+type relayedAddr string
+
+func (a relayedAddr) Network() string { return "relayed" }
+func (a relayedAddr) String() string  { return string(a) }
+
+// relayedTransport is connection relayed by another instance, its remote address is the address of the client.
+type relayedTransport struct {
+	Transport
+	client net.Addr
+}
+
+func (t *relayedTransport) RemoteAddr() net.Addr { return t.client }
+
+// acceptRelayed checks node message starting connection relayed by another instance and counts the connection
+// for the client address. It returns the connection with the client address.
+func acceptRelayed(transport Transport, frame Frame) (Transport, error) {
+	args := strings.SplitN(string(frame.Data), ArgSep, 2)
+	if len(args) != 2 || args[0] == "" {
+		return nil, fmt.Errorf("wrong number of arguments" + ArgSep + SrvErrInvalidOp)
+	}
+	trusted := isPeerIP(getAddrIP(transport.RemoteAddr()))
+	if nodeSecret != "" && subtle.ConstantTimeCompare([]byte(args[1]), []byte(nodeSecret)) == 1 {
+		trusted = true
+	}
+	if !trusted {
+		return nil, fmt.Errorf("relayed connection not trusted" + ArgSep + SrvErrInvalidOp)
+	}
+	client := relayedAddr(args[0])
+	if IsAddrBanned(client) {
+		return nil, fmt.Errorf("client is banned" + ArgSep + SrvErrInvalidOp)
+	}
+	if err := relayConnection(transport, client); err != nil {
+		return nil, err
+	}
+	return &relayedTransport{Transport: transport, client: client}, nil
+}
+
+// handOffClient relays frames between the client and the instance owning its player until one side closes.
+func handOffClient(transport Transport, owner Transport) {
+	defer owner.Close()
+	Log.Info("client handed off to instance owning the player", F(logKeyRemote, transport.RemoteAddr().String()), F("node", owner.RemoteAddr().String()))
+	done := make(chan struct{}, 2)
+	go func() {
+		relayFrames(owner, transport)
+		done <- struct{}{}
+	}()
+	go func() {
+		relayFrames(transport, owner)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// relayFrames writes frames read from src to dst until reading or writing fails, invalid frames are skipped.
+func relayFrames(src Transport, dst Transport) {
+	for {
+		frame, err := src.ReadFrame()
+		if _, ok := err.(*frameError); ok {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if err := dst.WriteFrame(frame); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSessionStore(t *testing.T, first SessionStore, second SessionStore) {
+	if err := first.Put(Session{Name: "alice", Node: "node1"}); err != nil {
+		t.Fatal(err)
+	}
+	session, ok, err := second.Get("alice")
+	if err != nil || !ok || session.Node != "node1" {
+		t.Fatalf("get returned %v %v %v, expected session of node1", session, ok, err)
+	}
+	if err := second.Delete("alice", "node2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := first.Get("alice"); !ok {
+		t.Error("session deleted by instance not owning it")
+	}
+	if err := second.Delete("alice", "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := first.Get("alice"); ok {
+		t.Error("session not deleted by its owner")
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore()
+	testSessionStore(t, store, store)
+}
+
+func TestFileSessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	testSessionStore(t, NewFileSessionStore(path), NewFileSessionStore(path))
+}
+
+// startFakeNode starts node answering every received frame with frames returned by respond.
+func startFakeNode(t *testing.T, respond func(Frame) []Frame) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				node := &connTransport{conn: c, maxDataLen: maxFrameDataLen}
+				defer node.Close()
+				for {
+					frame, err := node.ReadFrame()
+					if err != nil {
+						return
+					}
+					for _, response := range respond(frame) {
+						if node.WriteFrame(response) != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// respondAsOwner accepts relayed connection, answers login with recovery and echoes other frames,
+// like instance owning the player.
+func respondAsOwner(frame Frame) []Frame {
+	switch frame.Opcode {
+	case nodeRelayOpcode:
+		frame.Data = []byte(ClientMsgOk + ArgSep)
+	case MsgLoginOpcode:
+		frame.Data = []byte(ClientMsgErr + ArgSep + ClientMsgRecoveryLogin)
+	}
+	return []Frame{frame}
+}
+
+func TestHandOffToOwner(t *testing.T) {
+	store := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	ConfigureSessions(store, "127.0.0.1:1", "secret")
+	defer ConfigureSessions(NewMemorySessionStore(), "", "")
+	if err := store.Put(Session{Name: "moved", Node: startFakeNode(t, respondAsOwner)}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := connectTestClient(t)
+	defer c.conn.Close()
+	if response := c.login("moved"); response != ClientMsgErr+ArgSep+ClientMsgRecoveryLogin {
+		t.Fatalf("login response %q, expected recovery from owner", response)
+	}
+	c.send(MsgRecoveryOpcode, "echo")
+	if response := string(c.expect(MsgRecoveryOpcode).Data); response != "echo" {
+		t.Errorf("relayed response %q, expected echo", response)
+	}
+	if players.GetPlayerByName("moved") != nil {
+		t.Error("handed off player logged in locally")
+	}
+}
+
+func TestHandOffKeepsCapabilities(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l)
+	store := NewMemorySessionStore()
+	ConfigureSessions(store, "127.0.0.1:1", "secret")
+	defer ConfigureSessions(NewMemorySessionStore(), "", "")
+	if err := store.Put(Session{Name: "capable", Node: l.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := connectTestClient(t)
+	defer c.conn.Close()
+	c.send(MsgHelloOpcode, fmt.Sprint(ProtocolVersion), CapHeartbeat)
+	c.expectData(MsgHelloOpcode, ClientMsgOk)
+	c.login("capable")
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	player := players.GetPlayerByName("capable")
+	if player == nil || player.Protocol != ProtocolVersion || !player.HasCapability(CapHeartbeat) {
+		t.Fatalf("player %v on the owner lost negotiated protocol", player)
+	}
+	//player logged in locally instead of handed off would have the pipe address of the client
+	if addr := player.Conn.RemoteAddr(); addr.Network() != "relayed" || addr.String() != "pipe" {
+		t.Errorf("owner sees client at %s %q, expected relayed address of the client", addr.Network(), addr)
+	}
+}
+
+func TestRelayedConnection(t *testing.T) {
+	ConfigureSessions(NewMemorySessionStore(), "127.0.0.1:1", "secret")
+	defer ConfigureSessions(NewMemorySessionStore(), "", "")
+	if _, err := bans.Add(BanKindIP, "192.0.2.7", "test", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer bans.Remove(BanKindIP, "192.0.2.7")
+
+	cases := map[string]string{
+		"192.0.2.8:1000;secret": ClientMsgOk,
+		"192.0.2.8:1000;wrong":  ClientMsgErr,
+		"192.0.2.7:1000;secret": ClientMsgErr,
+		"192.0.2.8:1000":        ClientMsgErr,
+	}
+	for data, expected := range cases {
+		c := connectTestClient(t)
+		c.send(nodeRelayOpcode, data)
+		c.expectData(nodeRelayOpcode, expected)
+		c.conn.Close()
+	}
+}
+
+func TestFileSessionLock(t *testing.T) {
+	clock := useFakeClock(t)
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store := NewFileSessionStore(path)
+	if err := ioutil.WriteFile(path+".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	//lock held by another instance is waited for until the timeout
+	timers := clock.Timers()
+	done := make(chan error, 1)
+	go func() { done <- store.Put(Session{Name: "locked", Node: "node1"}) }()
+	for clock.Timers() == timers {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(sessionLockTimeout)
+	if err := <-done; err != errSessionLock {
+		t.Fatalf("put returned %v, expected lock timeout", err)
+	}
+
+	//lock older than the timeout was left by a crashed instance
+	clock.Advance(time.Second)
+	if err := store.Put(Session{Name: "stale", Node: "node1"}); err != nil {
+		t.Fatalf("stale lock not taken over: %v", err)
+	}
+}
+
+// blockedSessionStore is a session store whose changes wait until unblock is closed.
+type blockedSessionStore struct {
+	SessionStore
+	unblock chan struct{}
+}
+
+func (s *blockedSessionStore) Put(session Session) error {
+	<-s.unblock
+	return s.SessionStore.Put(session)
+}
+
+func TestSlowSessionStore(t *testing.T) {
+	store := &blockedSessionStore{SessionStore: NewMemorySessionStore(), unblock: make(chan struct{})}
+	ConfigureSessions(store, "127.0.0.1:1", "secret")
+	defer ConfigureSessions(NewMemorySessionStore(), "", "")
+	defer kickTestPlayers("slowstore")
+
+	//login is answered while the store is still writing
+	c := connectTestClient(t)
+	defer c.conn.Close()
+	if response := c.login("slowstore"); !strings.HasPrefix(response, ClientMsgOk) {
+		t.Fatalf("login response %q", response)
+	}
+	close(store.unblock)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if session, ok, _ := store.Get("slowstore"); ok && session.Node == "127.0.0.1:1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session not saved after the store was unblocked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
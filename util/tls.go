@@ -0,0 +1,148 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// validity of generated self-signed certificate
+const selfSignedValidity = 24 * time.Hour
+
+// TLSOptions configures TLS of the game listener.
+type TLSOptions struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string   // if set, clients must present certificate signed by CA from this file
+	SelfSigned   bool     // generate certificate at startup instead of loading it (development only)
+	Hosts        []string // names and addresses of generated certificate
+}
+
+// Enabled returns true if listener should use TLS.
+func (o TLSOptions) Enabled() bool {
+	return o.SelfSigned || o.CertFile != "" || o.KeyFile != ""
+}
+
+// NewTLSConfig creates server TLS configuration from options.
+func NewTLSConfig(o TLSOptions) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if o.SelfSigned {
+		if o.CertFile != "" || o.KeyFile != "" {
+			return nil, fmt.Errorf("self-signed mode cannot be combined with cert and key files")
+		}
+		cert, err = generateSelfSignedCert(o.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate certificate: %v", err)
+		}
+		fingerprint := sha256.Sum256(cert.Certificate[0])
+		Log.Warn("using generated self-signed certificate, do not use in production", F("sha256", fmt.Sprintf("%x", fingerprint)))
+	} else {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("both cert and key files are required")
+		}
+		cert, err = tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load certificate: %v", err)
+		}
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if o.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", o.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSOptions configures TLS of a client of the game listener.
+type ClientTLSOptions struct {
+	CAFile     string // CA of the server certificate, system roots are used if empty
+	ServerName string // name the server certificate is verified for, host of the dialed address if empty
+	CertFile   string // client certificate presented to listeners requiring one (optional)
+	KeyFile    string
+}
+
+// NewClientTLSConfig creates client TLS configuration from options.
+func NewClientTLSConfig(o ClientTLSOptions) (*tls.Config, error) {
+	config := &tls.Config{ServerName: o.ServerName, MinVersion: tls.VersionTLS12}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("both client cert and key files are required")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// generateSelfSignedCert generates ECDSA certificate for hosts signed by itself.
+// The certificate can also be used as CA and client certificate in tests.
+func generateSelfSignedCert(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"KIVUPS dev"}, CommonName: "kivups"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,166 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const pingRequest = MsgMagic + MsgPingOpcode + "0000"
+
+// startTLSServer serves game protocol on in-process TLS listener with Serve like main.
+func startTLSServer(t *testing.T, config *tls.Config) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go Serve(l)
+	return l.Addr().String()
+}
+
+// exchangePing sends ping and returns the response.
+func exchangePing(c net.Conn) (string, error) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(pingRequest)); err != nil {
+		return "", err
+	}
+	data := make([]byte, len(createOpCode(MsgPingOpcode, true, "ping")))
+	_, err := io.ReadFull(c, data)
+	return string(data), err
+}
+
+func newSelfSignedConfig(t *testing.T, clientCAFile string) *tls.Config {
+	config, err := NewTLSConfig(TLSOptions{SelfSigned: true, Hosts: []string{"127.0.0.1"}, ClientCAFile: clientCAFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func certPool(cert tls.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	return pool
+}
+
+func TestTLSListenerPing(t *testing.T) {
+	config := newSelfSignedConfig(t, "")
+	addr := startTLSServer(t, config)
+
+	c, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: certPool(config.Certificates[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	response, err := exchangePing(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := createOpCode(MsgPingOpcode, true, "ping"); response != expected {
+		t.Errorf("response %q, expected %q", response, expected)
+	}
+}
+
+func TestTLSRejectsUntrustedServer(t *testing.T) {
+	addr := startTLSServer(t, newSelfSignedConfig(t, ""))
+
+	c, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: x509.NewCertPool()})
+	if err == nil {
+		c.Close()
+		t.Fatal("handshake with untrusted certificate succeeded")
+	}
+}
+
+// writePEM writes certificate and its key to files in dir and returns their paths.
+func writePEM(t *testing.T, dir string, name string, cert tls.Certificate) (certFile string, keyFile string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// dialTLS connects to addr with client configuration created from options.
+func dialTLS(t *testing.T, addr string, o ClientTLSOptions) (*tls.Conn, error) {
+	config, err := NewClientTLSConfig(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Dial("tcp", addr, config)
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, err := generateSelfSignedCert(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCertFile, clientKeyFile := writePEM(t, dir, "client", clientCert)
+	config := newSelfSignedConfig(t, clientCertFile)
+	serverCA, _ := writePEM(t, dir, "server", config.Certificates[0])
+	addr := startTLSServer(t, config)
+
+	//without certificate the server aborts handshake, TLS 1.3 client notices it on first read
+	c, err := dialTLS(t, addr, ClientTLSOptions{CAFile: serverCA})
+	if err == nil {
+		_, err = exchangePing(c)
+		c.Close()
+	}
+	if err == nil {
+		t.Error("client without certificate was accepted")
+	}
+
+	c, err = dialTLS(t, addr, ClientTLSOptions{CAFile: serverCA, CertFile: clientCertFile, KeyFile: clientKeyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := exchangePing(c); err != nil {
+		t.Errorf("client with certificate was rejected: %v", err)
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	config := newSelfSignedConfig(t, "")
+	serverCA, _ := writePEM(t, t.TempDir(), "server", config.Certificates[0])
+	addr := startTLSServer(t, config)
+
+	if c, err := dialTLS(t, addr, ClientTLSOptions{CAFile: serverCA, ServerName: "other.example"}); err == nil {
+		c.Close()
+		t.Error("certificate accepted for a name it was not issued for")
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	if (TLSOptions{}).Enabled() {
+		t.Error("empty options enable TLS")
+	}
+	if _, err := NewTLSConfig(TLSOptions{CertFile: "cert.pem"}); err == nil {
+		t.Error("missing key file accepted")
+	}
+	if _, err := NewTLSConfig(TLSOptions{SelfSigned: true, CertFile: "cert.pem", KeyFile: "key.pem"}); err == nil {
+		t.Error("self-signed mode with cert files accepted")
+	}
+	if _, err := NewClientTLSConfig(ClientTLSOptions{CertFile: "client.pem"}); err == nil {
+		t.Error("client cert without key file accepted")
+	}
+	if _, err := NewClientTLSConfig(ClientTLSOptions{CAFile: "missing.pem"}); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
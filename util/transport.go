@@ -0,0 +1,229 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// max data length of a frame allowed by its header (4 digits)
+const maxFrameDataLen = 9999
+
+// wire formats of connection transport
+const (
+	wireUnknown = iota //no frame received yet, text format is used for writing
+	wireText
+	wireJSON
+)
+
+// frameError is an error of a frame which was consumed without breaking the stream, reading can continue.
+// Other read errors leave the stream in unknown position (e.g. the header is garbage, so the length of data
+// is unknown), reading cannot resynchronise and the connection is closed.
+type frameError struct {
+	msg string
+}
+
+func (e *frameError) Error() string {
+	return e.msg
+}
+
+// frame read errors
+var (
+	errFrameMagic    = errors.New("msg header was incorrect")
+	errFrameLength   = errors.New("couldnt get data length")
+	errNoTransport   = errors.New("player has no connection")
+	errFrameTooLarge = &frameError{msg: "data size is too large"} //data is skipped, its length is known
+)
+
+// isStreamError returns true if err is a frame error after which the stream cannot be read anymore.
+func isStreamError(err error) bool {
+	return err == errFrameMagic || err == errFrameLength
+}
+
+// Frame is one KIVUPS message.
+type Frame struct {
+	Opcode string
+	Data   []byte
+}
+
+// Transport carries frames between the server and one client.
+// WriteFrame can be called concurrently with ReadFrame and other WriteFrame calls.
+type Transport interface {
+	ReadFrame() (Frame, error)
+	WriteFrame(frame Frame) error
+	Close() error
+	RemoteAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// connTransport carries frames over a byte stream connection (TCP, TLS, WebSocket adapter, net.Pipe).
+// The magic word of the first received message selects text (KIVUPS) or JSON format for the connection.
+type connTransport struct {
+	conn       net.Conn
+	maxDataLen int
+	format     int32 //accessed atomically, writers read it
+	writeMu    sync.Mutex
+}
+
+// NewConnTransport returns transport of client connected by a byte stream connection.
+// Written frames are queued and sent by a writer goroutine (see outbound.go).
+func NewConnTransport(c net.Conn) Transport {
+	return newQueuedTransport(&connTransport{conn: c, maxDataLen: MaxDataLen})
+}
+
+// NewClientTransport returns transport of client end of a connection to the server (e.g. load testing tool).
+// Frames are written directly, server frames of any length allowed by the header are read.
+func NewClientTransport(c net.Conn) Transport {
+	return &connTransport{conn: c, maxDataLen: maxFrameDataLen}
+}
+
+// NewPipeTransport returns two ends of an in-memory connection, the server end for ProcessClient
+// and the client end for a client in the same process (e.g. tests).
+func NewPipeTransport() (Transport, Transport) {
+	server, client := net.Pipe()
+	return NewConnTransport(server), NewClientTransport(client)
+}
+
+func (t *connTransport) ReadFrame() (Frame, error) {
+	return readFrame(t.conn, &t.format, t.maxDataLen)
+}
+
+// readFrame reads one message from r, format holds wire format of the stream (accessed atomically).
+// On error of a message that was read whole (frameError) r is at the start of the next message.
+func readFrame(r io.Reader, format *int32, maxDataLen int) (Frame, error) {
+	magic := make([]byte, len(MsgMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return Frame{}, err
+	}
+	msgFormat := wireText
+	if string(magic) == MsgMagicJSON {
+		msgFormat = wireJSON
+	}
+	if !atomic.CompareAndSwapInt32(format, wireUnknown, int32(msgFormat)) && atomic.LoadInt32(format) != int32(msgFormat) {
+		return Frame{}, errFrameMagic //formats cannot be mixed
+	}
+	if msgFormat == wireJSON {
+		return readJSONFrame(r, magic, maxDataLen)
+	}
+
+	header := make([]byte, MsgHeaderLen)
+	copy(header, magic)
+	if _, err := io.ReadFull(r, header[len(magic):]); err != nil {
+		return Frame{}, err
+	}
+	opcode, dataLen, err := parseFrameHeader(header)
+	if err != nil {
+		return Frame{Opcode: opcode}, err
+	}
+	if dataLen > maxDataLen {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(dataLen)); err != nil {
+			return Frame{Opcode: opcode}, err
+		}
+		return Frame{Opcode: opcode}, errFrameTooLarge
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Frame{Opcode: opcode}, err
+	}
+	return Frame{Opcode: opcode, Data: data}, nil
+}
+
+// readJSONFrame reads rest of JSON message after magic word, body may be longer than maxDataLen up to maxJSONBodyLen.
+func readJSONFrame(r io.Reader, magic []byte, maxDataLen int) (Frame, error) {
+	header := make([]byte, len(MsgMagicJSON)+MaxMsgDataLen)
+	copy(header, magic)
+	if _, err := io.ReadFull(r, header[len(magic):]); err != nil {
+		return Frame{}, err
+	}
+	bodyLen, err := parseJSONHeader(header)
+	if err != nil {
+		return Frame{}, err
+	}
+	if bodyLen > maxJSONBodyLen && bodyLen > maxDataLen {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(bodyLen)); err != nil {
+			return Frame{}, err
+		}
+		return Frame{}, errFrameTooLarge
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Frame{}, err
+	}
+	return decodeJSONFrame(body)
+}
+
+func (t *connTransport) WriteFrame(frame Frame) error {
+	var msg []byte
+	if atomic.LoadInt32(&t.format) == wireJSON {
+		msg = encodeJSONFrame(frame)
+	} else {
+		msg = encodeFrame(frame)
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err := t.conn.Write(msg)
+	return err
+}
+
+func (t *connTransport) Close() error                       { return t.conn.Close() }
+func (t *connTransport) RemoteAddr() net.Addr               { return t.conn.RemoteAddr() }
+func (t *connTransport) SetReadDeadline(d time.Time) error  { return t.conn.SetReadDeadline(d) }
+func (t *connTransport) SetWriteDeadline(d time.Time) error { return t.conn.SetWriteDeadline(d) }
+
+// parseFrameHeader returns opcode and data length from the header of a frame.
+// Opcode and length must be decimal digits only, e.g. sign or space in length is an error.
+func parseFrameHeader(header []byte) (string, int, error) {
+	if len(header) != MsgHeaderLen || string(header[:len(MsgMagic)]) != MsgMagic {
+		return "", 0, errFrameMagic
+	}
+	opcode := header[len(MsgMagic) : len(MsgMagic)+len(MsgLoginOpcode)]
+	if _, ok := parseDigits(opcode); !ok {
+		return "", 0, errFrameMagic
+	}
+	dataLen, ok := parseDigits(header[len(MsgMagic)+len(MsgLoginOpcode):])
+	if !ok {
+		return string(opcode), 0, errFrameLength
+	}
+	return string(opcode), dataLen, nil
+}
+
+// parseDigits returns value of a non-empty string of decimal digits.
+func parseDigits(b []byte) (int, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	value := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		value = value*10 + int(c-'0')
+	}
+	return value, true
+}
+
+// encodeFrame returns frame as KIVUPS message.
+func encodeFrame(frame Frame) []byte {
+	return []byte(MsgMagic + frame.Opcode + fmt.Sprintf("%04d", len(frame.Data)) + string(frame.Data))
+}
+
+// decodeFrame returns frame of a complete KIVUPS message.
+func decodeFrame(msg []byte) (Frame, error) {
+	if len(msg) < MsgHeaderLen {
+		return Frame{}, errFrameMagic
+	}
+	opcode, dataLen, err := parseFrameHeader(msg[:MsgHeaderLen])
+	if err != nil {
+		return Frame{}, err
+	}
+	if dataLen != len(msg)-MsgHeaderLen {
+		return Frame{}, errFrameLength
+	}
+	return Frame{Opcode: opcode, Data: msg[MsgHeaderLen:]}, nil
+}
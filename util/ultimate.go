@@ -0,0 +1,108 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Ultimate tic-tac-toe is played on a 9x9 board made of 3x3 sub-boards.
+// A move sends the opponent to the sub-board matching the cell played inside its sub-board,
+// a won sub-board counts as a mark on the 3x3 macro board and the macro board decides the game.
+
+// NewUltimateTicTacToeGame creates a new ultimate tic-tac-toe game.
+func NewUltimateTicTacToeGame() *TicTacToeGame {
+	game := NewTickTackToeGame(ultimateSubBoardSize*ultimateSubBoardSize, ultimateSeats, ultimateSubBoardSize)
+	game.gameType = UltimateGame
+	game.resetUltimate()
+	return game
+}
+
+// resetUltimate clears the macro board and lets the first move be played anywhere.
+// Caller must hold g.mu.
+func (g *TicTacToeGame) resetUltimate() {
+	g.macroBoard = make([][]int, ultimateSubBoardSize)
+	for i := 0; i < ultimateSubBoardSize; i++ {
+		g.macroBoard[i] = make([]int, ultimateSubBoardSize)
+	}
+	g.activeSubBoard = anySubBoard
+}
+
+// checkUltimateMove checks if the move at x, y is played in the active sub-board and the sub-board is not decided yet.
+// Caller must hold g.mu.
+func (g *TicTacToeGame) checkUltimateMove(x int, y int) error {
+	subBoard := getSubBoardIndex(x, y)
+	if g.macroBoard[subBoard/ultimateSubBoardSize][subBoard%ultimateSubBoardSize] != 0 {
+		return errors.New("sub-board already decided")
+	}
+	if g.activeSubBoard != anySubBoard && g.activeSubBoard != subBoard {
+		return fmt.Errorf("move must be played in sub-board %d", g.activeSubBoard)
+	}
+	return nil
+}
+
+// updateUltimateState updates the macro board, active sub-board and game state after player placed symbol to x, y.
+// Sub-board is captured by the symbol completing its line.
+// Caller must hold g.mu.
+func (g *TicTacToeGame) updateUltimateState(player Player, symbol int, x int, y int) {
+	subBoard := getSubBoardIndex(x, y)
+	cells := g.getSubBoard(subBoard)
+	if checkLines(cells, symbol, ultimateSubBoardSize) {
+		g.macroBoard[subBoard/ultimateSubBoardSize][subBoard%ultimateSubBoardSize] = symbol
+	} else if isBoardFull(cells) {
+		g.macroBoard[subBoard/ultimateSubBoardSize][subBoard%ultimateSubBoardSize] = drawnSubBoard
+	}
+
+	//opponent is sent to the sub-board matching the played cell, if it is decided he can play anywhere
+	next := (x%ultimateSubBoardSize)*ultimateSubBoardSize + y%ultimateSubBoardSize
+	if g.macroBoard[next/ultimateSubBoardSize][next%ultimateSubBoardSize] != 0 {
+		next = anySubBoard
+	}
+	g.activeSubBoard = next
+
+	//check win
+	if checkLines(g.macroBoard, symbol, ultimateSubBoardSize) {
+		g.lineCompleted(player)
+		return
+	}
+	//check draw
+	if isBoardFull(g.macroBoard) {
+		g.setDraw()
+	}
+}
+
+// getSubBoard returns copy of the cells of the sub-board with given index.
+func (g *TicTacToeGame) getSubBoard(subBoard int) [][]int {
+	rowOffset := (subBoard / ultimateSubBoardSize) * ultimateSubBoardSize
+	colOffset := (subBoard % ultimateSubBoardSize) * ultimateSubBoardSize
+	cells := make([][]int, ultimateSubBoardSize)
+	for i := 0; i < ultimateSubBoardSize; i++ {
+		cells[i] = make([]int, ultimateSubBoardSize)
+		copy(cells[i], g.board[rowOffset+i][colOffset:colOffset+ultimateSubBoardSize])
+	}
+	return cells
+}
+
+// getUltimateBoardInParsableFormat returns board, active sub-board and macro board separated by boardPartSep.
+// Active sub-board is numbered 0..8 row by row, -1 means any sub-board.
+// Caller must hold g.mu.
+func (g *TicTacToeGame) getUltimateBoardInParsableFormat() string {
+	return g.formatBoard(g.board) + boardPartSep + strconv.Itoa(g.activeSubBoard) + boardPartSep + g.formatBoard(g.macroBoard)
+}
+
+// getSubBoardIndex returns index (0..8, row by row) of the sub-board containing x, y.
+func getSubBoardIndex(x int, y int) int {
+	return (x/ultimateSubBoardSize)*ultimateSubBoardSize + y/ultimateSubBoardSize
+}
+
+// isBoardFull returns true if there is no empty field on the board.
+func isBoardFull(board [][]int) bool {
+	for _, row := range board {
+		for _, col := range row {
+			if col == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
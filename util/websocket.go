@@ -0,0 +1,326 @@
+package util
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket (RFC 6455) transport, each WebSocket message carries one KIVUPS or JSON message.
+// Fragmented messages are reassembled, a message whose header declares other length than the message has
+// closes the connection, so messages cannot be split or spliced across WebSocket messages.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// WebSocket close status codes
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocolErr = 1002
+	wsCloseInvalidData = 1007
+	wsCloseTooBig      = 1009
+)
+
+const (
+	wsMaxControlLen = 125
+	wsMaxTextLen    = MsgHeaderLen + MaxDataLen                          //one KIVUPS message
+	wsMaxJSONLen    = len(MsgMagicJSON) + MaxMsgDataLen + maxJSONBodyLen //one JSON message
+	wsCloseTimeout  = time.Second
+)
+
+// wsMaxMessageLen is the max length of a message in either format.
+var wsMaxMessageLen = maxInt(wsMaxTextLen, wsMaxJSONLen)
+
+var errWSClosed = errors.New("websocket: use of closed connection")
+
+// WebSocketHandler returns handler upgrading requests to WebSocket connections and passing them to serve.
+// If origins is not empty, only browsers from the listed origins are accepted.
+func WebSocketHandler(origins []string, serve func(net.Conn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+			!headerContains(r.Header, "Upgrade", "websocket") {
+			http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if key == "" {
+			http.Error(w, "missing websocket key", http.StatusBadRequest)
+			return
+		}
+		if !isOriginAllowed(origins, r.Header.Get("Origin")) {
+			Log.Info("rejected websocket origin", F(logKeyRemote, r.RemoteAddr), F("origin", r.Header.Get("Origin")))
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "websocket not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			Log.Warn("could not hijack websocket connection", F(logKeyRemote, r.RemoteAddr), F(logKeyError, err))
+			return
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+getWebSocketAccept(key)+"\r\n\r\n")
+		if err != nil {
+			conn.Close()
+			return
+		}
+		serve(&wsConn{Conn: conn, br: rw.Reader})
+	})
+}
+
+// wsConn adapts WebSocket connection to net.Conn, so it is carried by the same transport as TCP.
+// Every Write is sent as one text message.
+type wsConn struct {
+	net.Conn
+	br        *bufio.Reader //hijacked reader, may hold already received bytes
+	message   []byte        //unread rest of the current message
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// Read reads payload of data messages, control frames are handled on the way.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.message) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.message = message
+	}
+	n := copy(p, c.message)
+	c.message = c.message[n:]
+	return n, nil
+}
+
+// readMessage reads frames until a whole data message is received and returns its payload.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.nextFrame(wsMaxMessageLen - len(message))
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpContinuation:
+			if !started {
+				return nil, c.fail(wsCloseProtocolErr, "continuation frame without message")
+			}
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, c.fail(wsCloseProtocolErr, "new message before the previous one finished")
+			}
+			started = true
+		default:
+			continue //control frame
+		}
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+		if declared, ok := getDeclaredMessageLen(message); ok && declared != len(message) {
+			return nil, c.fail(wsCloseInvalidData, "websocket message must carry exactly one message")
+		}
+		if len(message) > 0 {
+			return message, nil
+		}
+		started = false
+	}
+}
+
+// getDeclaredMessageLen returns length of KIVUPS or JSON message declared by its header, at least length of
+// the header. It returns false if the length is not valid, the transport rejects such message.
+func getDeclaredMessageLen(message []byte) (int, bool) {
+	headerLen := len(MsgMagic) + len(MsgLoginOpcode) + MaxMsgDataLen
+	if strings.HasPrefix(string(message), MsgMagicJSON) {
+		headerLen = len(MsgMagicJSON) + MaxMsgDataLen
+	}
+	if len(message) < headerLen {
+		return headerLen, true
+	}
+	bodyLen, ok := parseDigits(message[headerLen-MaxMsgDataLen : headerLen])
+	return headerLen + bodyLen, ok
+}
+
+// nextFrame reads the next frame and returns its unmasked payload, data frame payload may have at most
+// maxLen bytes. Control frames are handled before they are returned.
+func (c *wsConn) nextFrame(maxLen int) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if !masked {
+		return false, 0, nil, c.fail(wsCloseProtocolErr, "client frame not masked")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	switch opcode {
+	case wsOpText, wsOpBinary, wsOpContinuation:
+		if length > int64(maxLen) {
+			return false, 0, nil, c.fail(wsCloseTooBig, "message too big")
+		}
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > wsMaxControlLen || !fin {
+			return false, 0, nil, c.fail(wsCloseProtocolErr, "invalid control frame")
+		}
+	default:
+		return false, 0, nil, c.fail(wsCloseProtocolErr, "unknown opcode")
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	switch opcode {
+	case wsOpPing:
+		err = c.writeFrame(wsOpPong, payload)
+	case wsOpClose:
+		c.closeWith(wsCloseNormal, "")
+		err = io.EOF
+	}
+	return fin, opcode, payload, err
+}
+
+// Write sends p as one text message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	err := c.writeFrame(wsOpText, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes one unmasked final frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+		frame = append(append(frame, 127), ext[:]...)
+	}
+	frame = append(frame, payload...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends close frame and closes the underlying connection.
+func (c *wsConn) Close() error {
+	return c.closeWith(wsCloseNormal, "")
+}
+
+// closeWith sends close frame with status and closes the underlying connection, only the first call has effect.
+func (c *wsConn) closeWith(status int, reason string) error {
+	err := errWSClosed
+	c.closeOnce.Do(func() {
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(status))
+		payload = append(payload, reason...)
+		c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+		c.writeFrame(wsOpClose, payload)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// fail closes connection after protocol violation.
+func (c *wsConn) fail(status int, reason string) error {
+	c.closeWith(status, reason)
+	return fmt.Errorf("websocket: %s", reason)
+}
+
+// getWebSocketAccept returns value of Sec-WebSocket-Accept header for client key.
+func getWebSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains returns true if comma separated header contains token (case insensitive).
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isOriginAllowed returns true if origins is empty, the request is not from a browser or its origin is listed.
+func isOriginAllowed(origins []string, origin string) bool {
+	if len(origins) == 0 || origin == "" {
+		return true
+	}
+	for _, v := range origins {
+		if strings.EqualFold(v, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxInt returns the larger of a and b.
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// wsClientFrame returns masked client frame.
+func wsClientFrame(fin bool, opcode byte, payload string) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		var ext [2]byte
+		binary.BigEndian.PutUint16(ext[:], uint16(len(payload)))
+		frame = append(append(frame, 0x80|126), ext[:]...)
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame = append(frame, mask[:]...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// readWebSocket sends frames to the server end of WebSocket connection and returns what it reads until error.
+func readWebSocket(frames ...[]byte) (string, error) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		for _, v := range frames {
+			if _, err := client.Write(v); err != nil {
+				return
+			}
+		}
+	}()
+	ws := &wsConn{Conn: server, br: bufio.NewReader(server)}
+	go io.Copy(ioutil.Discard, client)
+	defer ws.Close()
+	var received strings.Builder
+	buf := make([]byte, 64)
+	for received.Len() < 1024 {
+		n, err := ws.Read(buf)
+		received.Write(buf[:n])
+		if err != nil {
+			return received.String(), err
+		}
+		if strings.HasSuffix(received.String(), "END") {
+			return received.String(), nil
+		}
+	}
+	return received.String(), nil
+}
+
+func TestWebSocketFragments(t *testing.T) {
+	ping := MsgMagic + MsgPingOpcode + "0000"
+	end := MsgMagic + MsgLoginOpcode + "0003END"
+	received, err := readWebSocket(
+		wsClientFrame(false, wsOpText, ping[:5]),
+		wsClientFrame(true, wsOpPing, ""),
+		wsClientFrame(true, wsOpContinuation, ping[5:]),
+		wsClientFrame(true, wsOpText, end))
+	if err != nil || received != ping+end {
+		t.Errorf("received %q %v, expected fragments joined into messages", received, err)
+	}
+}
+
+func TestWebSocketJSONMessage(t *testing.T) {
+	body := `{"op":"001","args":["` + strings.Repeat("a", MaxDataLen) + `"]}`
+	message := MsgMagicJSON + fmt.Sprintf("%04d", len(body)) + body
+	end := MsgMagic + MsgLoginOpcode + "0003END"
+	received, err := readWebSocket(wsClientFrame(true, wsOpText, message), wsClientFrame(true, wsOpText, end))
+	if err != nil || received != message+end {
+		t.Errorf("JSON message of %d bytes not received: %v", len(message), err)
+	}
+}
+
+func TestWebSocketMessageBoundaries(t *testing.T) {
+	ping := MsgMagic + MsgPingOpcode + "0000"
+	cases := map[string][][]byte{
+		"continuation without message": {wsClientFrame(true, wsOpContinuation, ping)},
+		"message inside message":       {wsClientFrame(false, wsOpText, ping[:5]), wsClientFrame(true, wsOpText, ping)},
+		"two messages in one":          {wsClientFrame(true, wsOpText, ping+ping)},
+		"message split in two":         {wsClientFrame(true, wsOpText, ping[:5]), wsClientFrame(true, wsOpText, ping[5:])},
+		"fragments over limit": {wsClientFrame(false, wsOpText, strings.Repeat("a", wsMaxMessageLen)),
+			wsClientFrame(true, wsOpContinuation, "a")},
+	}
+	for name, frames := range cases {
+		if received, err := readWebSocket(frames...); err == nil {
+			t.Errorf("%s: received %q without error", name, received)
+		}
+	}
+}